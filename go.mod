@@ -1,9 +1,17 @@
 module mitmgo
 
-go 1.16
+go 1.19
 
 require (
 	github.com/google/martian/v3 v3.2.1
 	github.com/google/uuid v1.3.0
 	github.com/pborman/getopt v1.1.0
+	github.com/youmark/pkcs8 v0.0.0-20201027041543-1326539a0a0a
+	software.sslmate.com/src/go-pkcs12 v0.4.0
+)
+
+require (
+	golang.org/x/crypto v0.11.0 // indirect
+	golang.org/x/net v0.10.0 // indirect
+	golang.org/x/text v0.11.0 // indirect
 )
@@ -0,0 +1,349 @@
+package core
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/youmark/pkcs8"
+	"mitmgo/src/core/common"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// CA证书、私钥以及中间证书
+type CAMaterial struct {
+	Cert  *x509.Certificate   // 用于签发的证书
+	Key   crypto.Signer       // 证书对应的私钥
+	Chain []*x509.Certificate // 其余的证书, 例如中间证书和根证书
+}
+
+// 解析CA相关的文件, 通过内容判断格式
+// 支持PEM(证书、PKCS#8/PKCS#1/SEC1私钥、加密的私钥)、DER和PKCS#12
+type caParser struct {
+	password string
+	certs    []*x509.Certificate
+	key      crypto.Signer
+}
+
+// 读取CA证书和私钥, 私钥可以和证书在同一个文件中(例如PKCS#12), 此时keyPath可以为空
+// chainPath中的证书作为中间证书, password用于PKCS#12和加密的私钥
+func LoadCA(certPath string, keyPath string, chainPath string, password string) (*CAMaterial, error) {
+	parser := &caParser{
+		password: password,
+	}
+
+	for _, path := range []string{certPath, keyPath, chainPath} {
+		if len(path) == 0 {
+			continue
+		}
+		// 私钥已经在证书文件中时, 忽略私钥路径
+		if path == keyPath && parser.key != nil {
+			continue
+		}
+
+		content, err := common.ReadFileBinary(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := parser.parse(content); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	return parser.material()
+}
+
+// 解析内存中的CA证书和私钥
+func ParseCA(certContent []byte, keyContent []byte, password string) (*CAMaterial, error) {
+	parser := &caParser{
+		password: password,
+	}
+
+	if err := parser.parse(certContent); err != nil {
+		return nil, err
+	}
+	if len(keyContent) > 0 {
+		if err := parser.parse(keyContent); err != nil {
+			return nil, err
+		}
+	}
+
+	return parser.material()
+}
+
+// 与私钥匹配的证书用于签发, 其余证书按签发关系排列为证书链
+func (p *caParser) material() (*CAMaterial, error) {
+	if len(p.certs) == 0 {
+		return nil, errors.New("not found the ca certificate")
+	}
+	if p.key == nil {
+		return nil, errors.New("not found the private key of the ca")
+	}
+
+	var signer *x509.Certificate
+	others := make([]*x509.Certificate, 0, len(p.certs))
+	for _, cert := range p.certs {
+		if signer == nil && checkKeyPair(cert, p.key) == nil {
+			signer = cert
+			continue
+		}
+		others = append(others, cert)
+	}
+	if signer == nil {
+		return nil, errors.New("the private key does not match the certificate")
+	}
+
+	return &CAMaterial{
+		Cert:  signer,
+		Key:   p.key,
+		Chain: buildChain(signer, others),
+	}, nil
+}
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil
+}
+
+// 从cert开始查找签发者, 直到根证书或者找不到签发者, 与证书链无关的证书会被忽略
+func buildChain(cert *x509.Certificate, certs []*x509.Certificate) []*x509.Certificate {
+	chain := make([]*x509.Certificate, 0, len(certs))
+	used := make([]bool, len(certs))
+
+	current := cert
+	for !isSelfSigned(current) {
+		var parent *x509.Certificate
+		for i, c := range certs {
+			if used[i] || c.Equal(current) {
+				continue
+			}
+			if bytes.Equal(current.RawIssuer, c.RawSubject) && current.CheckSignatureFrom(c) == nil {
+				used[i] = true
+				parent = c
+				break
+			}
+		}
+		if parent == nil {
+			break
+		}
+
+		chain = append(chain, parent)
+		current = parent
+	}
+
+	return chain
+}
+
+// 证书链中的根证书, 没有根证书时返回最上层的证书
+func RootOf(cert *x509.Certificate, chain []*x509.Certificate) *x509.Certificate {
+	if len(chain) == 0 {
+		return cert
+	}
+
+	return chain[len(chain)-1]
+}
+
+func (p *caParser) setKey(key crypto.Signer) error {
+	if p.key != nil {
+		return errors.New("found more than one private key")
+	}
+	p.key = key
+
+	return nil
+}
+
+func (p *caParser) parse(content []byte) error {
+	if bytes.Contains(content, []byte("-----BEGIN ")) {
+		return p.parsePEM(content)
+	}
+
+	return p.parseDER(content)
+}
+
+func (p *caParser) parsePEM(content []byte) error {
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			break
+		}
+
+		switch {
+		case block.Type == "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return err
+			}
+			p.certs = append(p.certs, cert)
+		case block.Type == "ENCRYPTED PRIVATE KEY":
+			key, err := p.parseEncryptedPKCS8(block.Bytes)
+			if err != nil {
+				return err
+			}
+			if err := p.setKey(key); err != nil {
+				return err
+			}
+		case block.Type == "PRIVATE KEY" || block.Type == "RSA PRIVATE KEY" || block.Type == "EC PRIVATE KEY":
+			der := block.Bytes
+			// 旧的openssl加密格式, 带有Proc-Type和DEK-Info头
+			if x509.IsEncryptedPEMBlock(block) {
+				if len(p.password) == 0 {
+					return errors.New("the private key is encrypted, a password is required")
+				}
+				var err error
+				der, err = x509.DecryptPEMBlock(block, []byte(p.password))
+				if err != nil {
+					return err
+				}
+			}
+			key, err := ParsePrivateKeyDER(der)
+			if err != nil {
+				return err
+			}
+			if err := p.setKey(key); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *caParser) parseEncryptedPKCS8(der []byte) (crypto.Signer, error) {
+	if len(p.password) == 0 {
+		return nil, errors.New("the private key is encrypted, a password is required")
+	}
+
+	key, err := pkcs8.ParsePKCS8PrivateKey(der, []byte(p.password))
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key")
+	}
+
+	return signer, nil
+}
+
+// 依次尝试DER证书、DER私钥、PKCS#12和加密的PKCS#8私钥
+func (p *caParser) parseDER(content []byte) error {
+	if certs, err := x509.ParseCertificates(content); err == nil && len(certs) > 0 {
+		p.certs = append(p.certs, certs...)
+		return nil
+	}
+
+	if key, err := ParsePrivateKeyDER(content); err == nil {
+		return p.setKey(key)
+	}
+
+	key, cert, caCerts, err := pkcs12.DecodeChain(content, p.password)
+	if err == nil {
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return errors.New("unsupported private key")
+		}
+		if err := p.setKey(signer); err != nil {
+			return err
+		}
+		p.certs = append(p.certs, cert)
+		p.certs = append(p.certs, caCerts...)
+		return nil
+	}
+	if err == pkcs12.ErrIncorrectPassword {
+		return errors.New("incorrect password of the pkcs#12 file")
+	}
+
+	if key, err := p.parseEncryptedPKCS8(content); err == nil {
+		return p.setKey(key)
+	}
+
+	return errors.New("unknown format, the supported formats: pem, der, pkcs#12")
+}
+
+// 检查私钥是否与证书的公钥匹配
+func checkKeyPair(cert *x509.Certificate, priv crypto.Signer) error {
+	certPub, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	keyPub, err := x509.MarshalPKIXPublicKey(priv.Public())
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(certPub, keyPub) {
+		return errors.New("the private key does not match the certificate")
+	}
+
+	return nil
+}
+
+// 只读取CA证书, 用于导出等不需要私钥的场景
+// 文件中有证书链时返回根证书, 设备上需要安装的是根证书
+func LoadCACert(certPath string, password string) (*x509.Certificate, error) {
+	parser := &caParser{
+		password: password,
+	}
+
+	content, err := common.ReadFileBinary(certPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := parser.parse(content); err != nil {
+		return nil, fmt.Errorf("%s: %v", certPath, err)
+	}
+	if len(parser.certs) == 0 {
+		return nil, errors.New("not found the ca certificate")
+	}
+
+	cert := parser.certs[0]
+	return RootOf(cert, buildChain(cert, parser.certs[1:])), nil
+}
+
+// 读取文件中的全部证书, 用于信任的根证书等场景
+func LoadCertificates(path string, password string) ([]*x509.Certificate, error) {
+	parser := &caParser{
+		password: password,
+	}
+
+	content, err := common.ReadFileBinary(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := parser.parse(content); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(parser.certs) == 0 {
+		return nil, fmt.Errorf("%s: not found any certificate", path)
+	}
+
+	return parser.certs, nil
+}
+
+// 读取证书和私钥, 格式与LoadCA相同, 用于客户端证书
+func LoadKeyPair(certPath string, keyPath string, password string) (tls.Certificate, error) {
+	material, err := LoadCA(certPath, keyPath, "", password)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	cert := tls.Certificate{
+		Certificate: [][]byte{material.Cert.Raw},
+		PrivateKey:  material.Key,
+		Leaf:        material.Cert,
+	}
+	for _, c := range material.Chain {
+		// 根证书不需要发送
+		if isSelfSigned(c) {
+			continue
+		}
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+
+	return cert, nil
+}
@@ -0,0 +1,312 @@
+package core
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/youmark/pkcs8"
+	"os"
+	"path/filepath"
+	"software.sslmate.com/src/go-pkcs12"
+	"testing"
+	"time"
+)
+
+// 使用parent签发一个中间证书
+func newTestIntermediate(t *testing.T, parent *CAMaterial, name string) *CAMaterial {
+	t.Helper()
+
+	key, err := GeneratePrivateKey(KeyTypeECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serialNumber, err := RandomSerialNumber()
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent.Cert, key.Public(), parent.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &CAMaterial{Cert: cert, Key: key}
+}
+
+func keyDER(t *testing.T, material *CAMaterial) []byte {
+	t.Helper()
+
+	der, err := x509.MarshalPKCS8PrivateKey(material.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func pemOf(blockType string, der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+}
+
+func joinBytes(items ...[]byte) []byte {
+	var result []byte
+	for _, item := range items {
+		result = append(result, item...)
+	}
+	return result
+}
+
+func TestParseCAFormats(t *testing.T) {
+	root := newTestCA(t)
+	intermediate := newTestIntermediate(t, root, "Test Intermediate CA")
+
+	encryptedPKCS8, err := pkcs8.MarshalPrivateKey(intermediate.Key, []byte("secret"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sec1, err := x509.MarshalECPrivateKey(intermediate.Key.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 旧的openssl加密格式
+	legacyBlock, err := x509.EncryptPEMBlock(rand.Reader, "EC PRIVATE KEY", sec1, []byte("secret"), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p12, err := pkcs12.Modern.Encode(intermediate.Key, intermediate.Cert, []*x509.Certificate{root.Cert}, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pemOf("CERTIFICATE", intermediate.Cert.Raw)
+	rootPEM := pemOf("CERTIFICATE", root.Cert.Raw)
+
+	tests := []struct {
+		name     string
+		cert     []byte
+		key      []byte
+		password string
+		chain    int
+	}{
+		{"pem pkcs8", certPEM, pemOf("PRIVATE KEY", keyDER(t, intermediate)), "", 0},
+		{"pem sec1", certPEM, pemOf("EC PRIVATE KEY", sec1), "", 0},
+		{"pem bundle", joinBytes(certPEM, rootPEM, pemOf("PRIVATE KEY", keyDER(t, intermediate))), nil, "", 1},
+		{"pem with text", joinBytes([]byte("subject=CN = test\n"), certPEM, rootPEM), pemOf("PRIVATE KEY", keyDER(t, intermediate)), "", 1},
+		{"der", intermediate.Cert.Raw, keyDER(t, intermediate), "", 0},
+		{"der sec1", intermediate.Cert.Raw, sec1, "", 0},
+		{"encrypted pkcs8 pem", certPEM, pemOf("ENCRYPTED PRIVATE KEY", encryptedPKCS8), "secret", 0},
+		{"encrypted pkcs8 der", certPEM, encryptedPKCS8, "secret", 0},
+		{"legacy encrypted pem", joinBytes(certPEM, rootPEM), pem.EncodeToMemory(legacyBlock), "secret", 1},
+		{"pkcs12 chain", p12, nil, "secret", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			material, err := ParseCA(tt.cert, tt.key, tt.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !material.Cert.Equal(intermediate.Cert) {
+				t.Fatalf("cert = %s", material.Cert.Subject)
+			}
+			if err := checkKeyPair(intermediate.Cert, material.Key); err != nil {
+				t.Fatal(err)
+			}
+			if len(material.Chain) != tt.chain {
+				t.Fatalf("the chain has %d certificates, want %d", len(material.Chain), tt.chain)
+			}
+			if tt.chain > 0 && !material.Chain[0].Equal(root.Cert) {
+				t.Fatalf("chain[0] = %s", material.Chain[0].Subject)
+			}
+		})
+	}
+}
+
+func TestParseCAErrors(t *testing.T) {
+	root := newTestCA(t)
+	other := newTestCA(t)
+
+	encryptedPKCS8, err := pkcs8.MarshalPrivateKey(root.Key, []byte("secret"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p12, err := pkcs12.Modern.Encode(root.Key, root.Cert, nil, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pemOf("CERTIFICATE", root.Cert.Raw)
+	keyPEM := pemOf("PRIVATE KEY", keyDER(t, root))
+
+	tests := []struct {
+		name     string
+		cert     []byte
+		key      []byte
+		password string
+	}{
+		{"no certificate", keyPEM, nil, ""},
+		{"no private key", certPEM, nil, ""},
+		{"mismatched key", certPEM, pemOf("PRIVATE KEY", keyDER(t, other)), ""},
+		{"two keys", joinBytes(certPEM, keyPEM), keyPEM, ""},
+		{"encrypted without password", certPEM, pemOf("ENCRYPTED PRIVATE KEY", encryptedPKCS8), ""},
+		{"encrypted with wrong password", certPEM, pemOf("ENCRYPTED PRIVATE KEY", encryptedPKCS8), "wrong"},
+		{"pkcs12 with wrong password", p12, nil, "wrong"},
+		{"unknown format", []byte("not a certificate"), nil, ""},
+		{"broken pem", pemOf("CERTIFICATE", []byte("broken")), keyPEM, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseCA(tt.cert, tt.key, tt.password); err == nil {
+				t.Fatal("ParseCA should fail")
+			}
+		})
+	}
+}
+
+// 使用与私钥匹配的证书签发, 不受证书在文件中的顺序影响
+func TestParseCASigner(t *testing.T) {
+	root := newTestCA(t)
+	intermediate := newTestIntermediate(t, root, "Test Intermediate CA")
+	issuing := newTestIntermediate(t, intermediate, "Test Issuing CA")
+	unrelated := newTestCA(t)
+
+	certs := [][]byte{
+		pemOf("CERTIFICATE", root.Cert.Raw),
+		pemOf("CERTIFICATE", unrelated.Cert.Raw),
+		pemOf("CERTIFICATE", issuing.Cert.Raw),
+		pemOf("CERTIFICATE", intermediate.Cert.Raw),
+	}
+
+	tests := []struct {
+		name   string
+		key    *CAMaterial
+		signer *x509.Certificate
+		chain  []*x509.Certificate
+	}{
+		{"issuing", issuing, issuing.Cert, []*x509.Certificate{intermediate.Cert, root.Cert}},
+		{"intermediate", intermediate, intermediate.Cert, []*x509.Certificate{root.Cert}},
+		{"root", root, root.Cert, nil},
+		{"unrelated", unrelated, unrelated.Cert, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			material, err := ParseCA(joinBytes(certs...), pemOf("PRIVATE KEY", keyDER(t, tt.key)), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !material.Cert.Equal(tt.signer) {
+				t.Fatalf("signer = %s, want %s", material.Cert.Subject, tt.signer.Subject)
+			}
+			if len(material.Chain) != len(tt.chain) {
+				t.Fatalf("the chain has %d certificates, want %d", len(material.Chain), len(tt.chain))
+			}
+			for i, cert := range tt.chain {
+				if !material.Chain[i].Equal(cert) {
+					t.Fatalf("chain[%d] = %s, want %s", i, material.Chain[i].Subject, cert.Subject)
+				}
+			}
+			if root := RootOf(material.Cert, material.Chain); len(tt.chain) > 0 && !isSelfSigned(root) {
+				t.Fatalf("root = %s", root.Subject)
+			}
+		})
+	}
+}
+
+func TestBuildChain(t *testing.T) {
+	root := newTestCA(t)
+	intermediate := newTestIntermediate(t, root, "Test Intermediate CA")
+	issuing := newTestIntermediate(t, intermediate, "Test Issuing CA")
+
+	// 缺少中间证书时到最上层的证书为止
+	if chain := buildChain(issuing.Cert, []*x509.Certificate{root.Cert}); len(chain) != 0 {
+		t.Fatalf("chain = %d certificates, want 0", len(chain))
+	}
+	if chain := buildChain(issuing.Cert, []*x509.Certificate{intermediate.Cert}); len(chain) != 1 || !chain[0].Equal(intermediate.Cert) {
+		t.Fatalf("chain = %d certificates, want 1", len(chain))
+	}
+
+	// 重复的证书只使用一次
+	chain := buildChain(issuing.Cert, []*x509.Certificate{root.Cert, intermediate.Cert, root.Cert, issuing.Cert})
+	if len(chain) != 2 || !chain[0].Equal(intermediate.Cert) || !chain[1].Equal(root.Cert) {
+		t.Fatalf("chain = %d certificates, want 2", len(chain))
+	}
+
+	// 同名但不是签发者的证书被忽略
+	impostor := newTestIntermediate(t, root, "Test Intermediate CA")
+	chain = buildChain(issuing.Cert, []*x509.Certificate{impostor.Cert, intermediate.Cert, root.Cert})
+	if len(chain) != 2 || !chain[0].Equal(intermediate.Cert) {
+		t.Fatal("the chain uses a certificate with the same subject but another key")
+	}
+}
+
+func TestLoadCAFiles(t *testing.T) {
+	root := newTestCA(t)
+	intermediate := newTestIntermediate(t, root, "Test Intermediate CA")
+	dir := t.TempDir()
+
+	write := func(name string, content []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	certPath := write("ca.crt", pemOf("CERTIFICATE", intermediate.Cert.Raw))
+	keyPath := write("ca.key", pemOf("PRIVATE KEY", keyDER(t, intermediate)))
+	chainPath := write("chain.der", root.Cert.Raw)
+
+	material, err := LoadCA(certPath, keyPath, chainPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !material.Cert.Equal(intermediate.Cert) || len(material.Chain) != 1 {
+		t.Fatalf("material = %s with %d certificates", material.Cert.Subject, len(material.Chain))
+	}
+
+	// PKCS#12中已经有私钥时忽略私钥路径
+	p12, err := pkcs12.Modern.Encode(intermediate.Key, intermediate.Cert, []*x509.Certificate{root.Cert}, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p12Path := write("ca.p12", p12)
+	if _, err := LoadCA(p12Path, keyPath, "", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 导出时使用根证书
+	cert, err := LoadCACert(p12Path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cert.Equal(root.Cert) {
+		t.Fatalf("LoadCACert = %s, want the root", cert.Subject)
+	}
+
+	// 客户端证书不发送根证书
+	pair, err := LoadKeyPair(p12Path, "", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pair.Certificate) != 1 || !pair.Leaf.Equal(intermediate.Cert) {
+		t.Fatalf("the key pair has %d certificates", len(pair.Certificate))
+	}
+
+	if _, err := LoadCA(filepath.Join(dir, "missing.crt"), keyPath, "", ""); err == nil {
+		t.Fatal("LoadCA with a missing file should fail")
+	}
+}
@@ -2,45 +2,193 @@ package core
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/pem"
-	"math/big"
+	"errors"
+	"mitmgo/src/core/common"
+	"net"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
 )
 
-// 生成CA证书, 返回证书和私钥
-func GenerateCA() ([]byte, []byte, error) {
+// 默认的CA私钥类型
+const DefaultCAKeyType = KeyTypeRSA4096
+
+// 生成CA的选项
+type CAOptions struct {
+	CommonName         string   `json:"commonName"`
+	Organization       string   `json:"organization"`
+	OrganizationalUnit string   `json:"organizationalUnit"`
+	Country            string   `json:"country"`
+	Province           string   `json:"province"`
+	Locality           string   `json:"locality"`
+	ValidityDays       int      `json:"validityDays"`      // 有效期(天)
+	KeyType            string   `json:"keyType"`           // 私钥类型
+	PermittedDomains   []string `json:"permittedDomains"`  // 允许签发的域名(包含子域名)
+	ExcludedDomains    []string `json:"excludedDomains"`   // 禁止签发的域名(包含子域名)
+	PermittedIPRanges  []string `json:"permittedIpRanges"` // 允许签发的IP或CIDR
+	ExcludedIPRanges   []string `json:"excludedIpRanges"`  // 禁止签发的IP或CIDR
+}
+
+// CommonName和Organization为空时生成CA时随机生成
+func NewCAOptions() *CAOptions {
+	return &CAOptions{
+		ValidityDays:     3650,
+		KeyType:          DefaultCAKeyType,
+		PermittedDomains: []string{},
+		ExcludedDomains:  []string{},
+	}
+}
+
+func parseIPRanges(items []string) ([]*net.IPNet, error) {
+	ranges := make([]*net.IPNet, 0, len(items))
+	for _, item := range items {
+		ipnet, err := common.ParseIPNet(item)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, ipnet)
+	}
+
+	return ranges, nil
+}
+
+// 设置名称约束, 限制CA只能用于指定的域名
+// 只限制了域名时同时禁止所有IP, 避免泄露的CA被用于IP访问的站点
+func (p *CAOptions) applyNameConstraints(ca *x509.Certificate) error {
+	var err error
+	for _, domain := range p.PermittedDomains {
+		ca.PermittedDNSDomains = append(ca.PermittedDNSDomains, strings.TrimPrefix(strings.ToLower(strings.TrimSpace(domain)), "*."))
+	}
+	for _, domain := range p.ExcludedDomains {
+		ca.ExcludedDNSDomains = append(ca.ExcludedDNSDomains, strings.TrimPrefix(strings.ToLower(strings.TrimSpace(domain)), "*."))
+	}
+
+	ca.PermittedIPRanges, err = parseIPRanges(p.PermittedIPRanges)
+	if err != nil {
+		return err
+	}
+	ca.ExcludedIPRanges, err = parseIPRanges(p.ExcludedIPRanges)
+	if err != nil {
+		return err
+	}
+
+	if len(ca.PermittedDNSDomains) > 0 && len(ca.PermittedIPRanges) == 0 {
+		ca.ExcludedIPRanges = append(ca.ExcludedIPRanges,
+			&net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+			&net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)})
+	}
+
+	ca.PermittedDNSDomainsCritical = len(ca.PermittedDNSDomains) > 0 ||
+		len(ca.ExcludedDNSDomains) > 0 ||
+		len(ca.PermittedIPRanges) > 0 ||
+		len(ca.ExcludedIPRanges) > 0
+
+	return nil
+}
+
+// 随机的CA主题, 避免每次生成的CA具有相同的特征
+func randomCASubject() (string, string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	organization := strings.ToUpper(hex.EncodeToString(b))
+
+	return organization + " Root CA", organization, nil
+}
+
+func firstOrEmpty(names []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	return names[0]
+}
+
+func nameOrEmpty(name string) []string {
+	if len(name) == 0 {
+		return nil
+	}
+
+	return []string{name}
+}
+
+// 生成CA证书, 返回证书和PKCS#8格式的私钥
+// options为空时使用默认选项, 序列号随机生成
+func GenerateCA(options *CAOptions) ([]byte, []byte, error) {
+	if options == nil {
+		options = NewCAOptions()
+	}
+
+	validityDays := options.ValidityDays
+	if validityDays <= 0 {
+		validityDays = 3650
+	}
+
+	serialNumber, err := RandomSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	commonName := options.CommonName
+	organization := options.Organization
+	if len(commonName) == 0 && len(organization) == 0 {
+		commonName, organization, err = randomCASubject()
+		if err != nil {
+			return nil, nil, err
+		}
+	} else if len(commonName) == 0 {
+		commonName = organization + " Root CA"
+	}
+
 	// set up our CA certificate
 	ca := &x509.Certificate{
-		SerialNumber: big.NewInt(2021),
+		SerialNumber: serialNumber,
 		Subject: pkix.Name{
-			Organization:  []string{"PentestingPlatform"},
-			Country:       []string{"CN"},
-			Province:      []string{""},
-			Locality:      []string{"xxxxnnxxxx"},
-			StreetAddress: []string{""},
-			PostalCode:    []string{"000000"},
+			CommonName:         commonName,
+			Organization:       nameOrEmpty(organization),
+			OrganizationalUnit: nameOrEmpty(options.OrganizationalUnit),
+			Country:            nameOrEmpty(options.Country),
+			Province:           nameOrEmpty(options.Province),
+			Locality:           nameOrEmpty(options.Locality),
 		},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().AddDate(10, 0, 0),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(0, 0, validityDays),
 		IsCA:                  true,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
 		BasicConstraintsValid: true,
 	}
 
+	if err := options.applyNameConstraints(ca); err != nil {
+		return nil, nil, err
+	}
+
+	keyType := options.KeyType
+	if len(keyType) == 0 {
+		keyType = DefaultCAKeyType
+	}
+
 	// create our private and public key
-	caPrivKey, err := rsa.GenerateKey(rand.Reader, 4096)
+	caPrivKey, err := GeneratePrivateKey(keyType)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ca.SubjectKeyId, err = SubjectKeyId(caPrivKey.Public())
 	if err != nil {
 		return nil, nil, err
 	}
 
 	// create the CA
-	caBytes, err := x509.CreateCertificate(rand.Reader, ca, ca, &caPrivKey.PublicKey, caPrivKey)
+	caBytes, err := x509.CreateCertificate(rand.Reader, ca, ca, caPrivKey.Public(), caPrivKey)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -52,46 +200,67 @@ func GenerateCA() ([]byte, []byte, error) {
 		Bytes: caBytes,
 	})
 
-	caPrivKeyPEM := new(bytes.Buffer)
-	pem.Encode(caPrivKeyPEM, &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(caPrivKey),
-	})
+	caPrivKeyPEM, err := MarshalPrivateKeyPEM(caPrivKey)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	return caPEM.Bytes(), caPrivKeyPEM.Bytes(), nil
+	return caPEM.Bytes(), caPrivKeyPEM, nil
+}
+
+// SignUrlByCA使用的签发器, 同一个CA共用缓存, key为CA证书的DER
+var (
+	urlIssuers      = make(map[string]*CertIssuer)
+	lock_urlIssuers sync.Mutex
+)
+
+func urlIssuerOf(ca *x509.Certificate, caPriKey crypto.Signer) (*CertIssuer, error) {
+	if ca == nil {
+		return nil, errors.New("the ca and the private key are required")
+	}
+
+	lock_urlIssuers.Lock()
+	defer lock_urlIssuers.Unlock()
+
+	if issuer, ok := urlIssuers[string(ca.Raw)]; ok {
+		return issuer, nil
+	}
+
+	issuer, err := NewCertIssuer(ca, caPriKey)
+	if err != nil {
+		return nil, err
+	}
+	urlIssuers[string(ca.Raw)] = issuer
+
+	return issuer, nil
 }
 
 // 对一个网址进行签名，生成服务器端证书
-func SignUrlByCA(ca *x509.Certificate, caPriKey *rsa.PrivateKey, lnk string) ([]byte, []byte, error) {
+// 证书以网址中的host作为DNS/IP SAN, 私钥为PKCS#8格式
+// 同一个CA的签发结果在内存中缓存, 代理中应使用 ProxyEntity.Issuer()
+func SignUrlByCA(ca *x509.Certificate, caPriKey crypto.Signer, lnk string) ([]byte, []byte, error) {
 	uri, err := url.Parse(lnk)
 	if err != nil {
 		return nil, nil, err
 	}
-	// set up our server certificate
-	cert := &x509.Certificate{
-		SerialNumber: big.NewInt(2019),
-		Subject: pkix.Name{
-			Organization:  []string{lnk},
-			Country:       []string{"CN"},
-			Province:      []string{" "},
-			Locality:      []string{"China"},
-			StreetAddress: []string{"000000"},
-			PostalCode:    []string{"000000"},
-		},
-		URIs:         []*url.URL{uri},
-		NotBefore:    time.Now(),
-		NotAfter:     time.Now().AddDate(10, 0, 0),
-		SubjectKeyId: []byte{1, 2, 3, 4, 6},
-		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
-		KeyUsage:     x509.KeyUsageDigitalSignature,
+
+	host := uri.Hostname()
+	if len(host) == 0 {
+		// 没有scheme时按host处理
+		host = common.StripPort(lnk)
 	}
 
-	certPrivKeyOfSpeical, err := rsa.GenerateKey(rand.Reader, 4096)
+	issuer, err := urlIssuerOf(ca, caPriKey)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	certOfSpeicalUrl, err := x509.CreateCertificate(rand.Reader, cert, ca, &certPrivKeyOfSpeical.PublicKey, caPriKey)
+	tlsc, err := issuer.Issue(host)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPrivKeyPEM, err := MarshalPrivateKeyPEM(tlsc.PrivateKey.(crypto.Signer))
 	if err != nil {
 		return nil, nil, err
 	}
@@ -99,14 +268,8 @@ func SignUrlByCA(ca *x509.Certificate, caPriKey *rsa.PrivateKey, lnk string) ([]
 	certPEM := new(bytes.Buffer)
 	pem.Encode(certPEM, &pem.Block{
 		Type:  "CERTIFICATE",
-		Bytes: certOfSpeicalUrl,
-	})
-
-	certPrivKeyPEM := new(bytes.Buffer)
-	pem.Encode(certPrivKeyPEM, &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(certPrivKeyOfSpeical),
+		Bytes: tlsc.Certificate[0],
 	})
 
-	return certPEM.Bytes(), certPrivKeyPEM.Bytes(), nil
+	return certPEM.Bytes(), certPrivKeyPEM, nil
 }
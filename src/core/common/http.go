@@ -1,8 +1,13 @@
 package common
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
 	"context"
 	"crypto/tls"
+	"errors"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"strings"
@@ -160,3 +165,28 @@ func (p *HttpModule) HEAD(url string, headers map[string]interface{}) (*HttpResu
 	}
 	return p.doRequest("HEAD", url, tmp, "")
 }
+
+// 按Content-Encoding解压内容, 最多读取maxSize+1个字节
+func DecodeContent(body []byte, encoding string, maxSize int) ([]byte, error) {
+	var reader io.Reader
+
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		gr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		reader = gr
+	case "deflate":
+		fr := flate.NewReader(bytes.NewReader(body))
+		defer fr.Close()
+		reader = fr
+	default:
+		return nil, errors.New("unsupported content encoding: " + encoding)
+	}
+
+	return ioutil.ReadAll(io.LimitReader(reader, int64(maxSize)+1))
+}
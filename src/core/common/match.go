@@ -0,0 +1,75 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+)
+
+// 去掉host中的端口
+func StripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+
+	return strings.Trim(host, "[]")
+}
+
+// 判断host是否匹配指定模式, 支持 "*.example.com" 和 path.Match 风格的通配符
+// "*.example.com" 同时匹配 example.com 本身
+func MatchHost(pattern string, host string) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	host = strings.ToLower(StripPort(strings.TrimSpace(host)))
+	if len(pattern) == 0 || len(host) == 0 {
+		return false
+	}
+
+	if pattern == "*" || pattern == host {
+		return true
+	}
+
+	if strings.HasPrefix(pattern, "*.") {
+		suffix := pattern[1:]
+		if strings.HasSuffix(host, suffix) || host == suffix[1:] {
+			return true
+		}
+	}
+
+	ok, err := path.Match(pattern, host)
+	if err != nil {
+		return false
+	}
+
+	return ok
+}
+
+// 判断host是否匹配任一模式
+func MatchHostAny(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if MatchHost(pattern, host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// 解析IP或者CIDR, 单个IP转换为只包含该IP的网段
+func ParseIPNet(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip: %s", s)
+		}
+		if ip.To4() != nil {
+			s += "/32"
+		} else {
+			s += "/128"
+		}
+	}
+
+	_, ipnet, err := net.ParseCIDR(s)
+	return ipnet, err
+}
@@ -12,6 +12,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 )
 
@@ -38,7 +39,7 @@ func IsExist(str string) bool {
 func ReadFileAll(path string) (string, error) {
 	file, err := os.Open(path)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 	defer file.Close()
 
@@ -53,7 +54,7 @@ func ReadFileAll(path string) (string, error) {
 func ReadFileBinary(path string) ([]byte, error) {
 	file, err := os.Open(path)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	defer file.Close()
 
@@ -136,8 +137,16 @@ func TrimEx(s string) string {
 }
 
 func CalcJSONFeatureStr(aMap map[string]interface{}) string {
+	// map的遍历顺序是随机的, 排序后特征才稳定
+	keys := make([]string, 0, len(aMap))
+	for key, _ := range aMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
 	result := ""
-	for key, val := range aMap {
+	for _, key := range keys {
+		val := aMap[key]
 		switch val.(type) {
 		case map[string]interface{}:
 			result += key + "{}"
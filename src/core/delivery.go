@@ -0,0 +1,372 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mitmgo/src/core/common"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 队列中的一项, 请求结果、host级别的记录、WebSocket消息或者不解密的连接
+type deliveryItem struct {
+	result      *RequestResult
+	host        *ServerCertResult
+	message     *WebSocketMessage
+	passthrough *PassthroughResult
+}
+
+// 将结果批量异步发送到 --remote-output-addr
+// 发送失败时按指数退避重试, 远程地址不可用时写入本地spool目录, 恢复后重新发送
+type Deliverer struct {
+	Id            string
+	Addr          string
+	BatchSize     int           // 每批最多发送的结果数
+	FlushInterval time.Duration // 不足一批时的最长等待时间
+	MaxRetries    int           // 每批最多重试次数
+	QueueSize     int           // 队列长度, 队列满时直接写入spool, 不阻塞调用者
+	SpoolDir      string        // 发送失败的数据保存目录
+
+	retryDelay time.Duration // 第一次重试前的等待时间, 之后每次加倍
+	queue      chan deliveryItem
+	httpModule *common.HttpModule
+	wg         sync.WaitGroup
+	closing    chan struct{}
+	lock_down  sync.Mutex
+	isDown     bool // 远程地址是否不可用
+	lock_spool sync.Mutex
+	lock_post  sync.Mutex
+	closeOnce  sync.Once
+}
+
+func NewDeliverer(id string,
+	addr string,
+	batchSize int,
+	flushInterval time.Duration,
+	maxRetries int,
+	queueSize int,
+	spoolDir string) *Deliverer {
+
+	if batchSize <= 0 {
+		batchSize = 20
+	}
+	if flushInterval <= 0 {
+		flushInterval = 2 * time.Second
+	}
+	if maxRetries < 0 {
+		maxRetries = 0
+	}
+	if queueSize <= 0 {
+		queueSize = 1000
+	}
+	if len(spoolDir) == 0 {
+		spoolDir = DefaultSpoolDir(id)
+	}
+
+	return &Deliverer{
+		Id:            id,
+		Addr:          addr,
+		BatchSize:     batchSize,
+		FlushInterval: flushInterval,
+		MaxRetries:    maxRetries,
+		QueueSize:     queueSize,
+		SpoolDir:      spoolDir,
+		retryDelay:    500 * time.Millisecond,
+		queue:         make(chan deliveryItem, queueSize),
+		closing:       make(chan struct{}),
+	}
+}
+
+// 默认的spool目录: 程序所在目录下的 log/spool/<id>
+func DefaultSpoolDir(id string) string {
+	if len(id) == 0 {
+		id = "default"
+	}
+	currentDir, _ := common.GetCurrentDir()
+
+	return filepath.Join(currentDir, "log", "spool", id)
+}
+
+func (p *Deliverer) Start() error {
+	// 没有spool目录时发送失败的结果会丢失
+	if len(p.SpoolDir) == 0 {
+		return errors.New("the spool directory of the deliverer is not set")
+	}
+	err := os.MkdirAll(p.SpoolDir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	httpModule, err := common.NewHttpModule()
+	if err != nil {
+		return err
+	}
+	p.httpModule = httpModule
+
+	p.wg.Add(2)
+	go p.loop()
+	go p.replayLoop()
+
+	return nil
+}
+
+func (p *Deliverer) Push(result RequestResult) {
+	p.push(deliveryItem{result: &result})
+}
+
+// 上游服务器的证书信息, 与请求结果一起发送
+func (p *Deliverer) PushServerCert(record ServerCertResult) {
+	p.push(deliveryItem{host: &record})
+}
+
+// WebSocket消息, 与请求结果一起发送
+func (p *Deliverer) PushWebSocketMessage(message WebSocketMessage) {
+	p.push(deliveryItem{message: &message})
+}
+
+// 不解密的连接, 与请求结果一起发送
+func (p *Deliverer) PushPassthrough(result PassthroughResult) {
+	p.push(deliveryItem{passthrough: &result})
+}
+
+// 加入发送队列, 队列满时直接写入spool, 由replayLoop重新发送
+// Push在返回响应之前调用, 不能等待发送
+func (p *Deliverer) push(item deliveryItem) {
+	select {
+	case <-p.closing:
+		p.spool([]deliveryItem{item})
+		return
+	default:
+	}
+
+	select {
+	case p.queue <- item:
+	default:
+		log.Println("delivery queue is full, spool the result to disk")
+		p.spool([]deliveryItem{item})
+	}
+}
+
+// 发送队列中剩余的结果, 仍然失败的写入spool
+func (p *Deliverer) Close() {
+	p.closeOnce.Do(func() {
+		close(p.closing)
+		p.wg.Wait()
+
+		if p.httpModule != nil {
+			p.httpModule.Release()
+		}
+	})
+}
+
+func (p *Deliverer) loop() {
+	defer p.wg.Done()
+
+	batch := make([]deliveryItem, 0, p.BatchSize)
+	ticker := time.NewTicker(p.FlushInterval)
+	defer ticker.Stop()
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		p.deliver(batch)
+		batch = make([]deliveryItem, 0, p.BatchSize)
+	}
+
+	for {
+		select {
+		case item := <-p.queue:
+			batch = append(batch, item)
+			if len(batch) >= p.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-p.closing:
+			// 取出队列中剩余的结果
+			for {
+				select {
+				case item := <-p.queue:
+					batch = append(batch, item)
+					if len(batch) >= p.BatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (p *Deliverer) content(batch []deliveryItem) string {
+	remoteResult := NewRemoteOutputCrawlResult()
+	remoteResult.Id = p.Id
+	for _, item := range batch {
+		if item.result != nil {
+			remoteResult.Result = append(remoteResult.Result, *item.result)
+		}
+		if item.host != nil {
+			remoteResult.Hosts = append(remoteResult.Hosts, *item.host)
+		}
+		if item.message != nil {
+			remoteResult.Messages = append(remoteResult.Messages, *item.message)
+		}
+		if item.passthrough != nil {
+			remoteResult.Passthrough = append(remoteResult.Passthrough, *item.passthrough)
+		}
+	}
+
+	return common.ToJsonEncodeStruct(remoteResult)
+}
+
+func (p *Deliverer) deliver(batch []deliveryItem) {
+	content := p.content(batch)
+
+	// 远程地址不可用时直接写入spool, 由replayLoop负责恢复
+	if p.down() {
+		p.spoolContent(content)
+		return
+	}
+
+	delay := p.retryDelay
+	for i := 0; ; i++ {
+		err := p.post(content)
+		if err == nil {
+			return
+		}
+		log.Println("Post the results to the server: " + err.Error())
+
+		if i >= p.MaxRetries {
+			break
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-p.closing:
+			// 退出时不再等待重试
+			i = p.MaxRetries
+		}
+
+		delay *= 2
+		if delay > 30*time.Second {
+			delay = 30 * time.Second
+		}
+	}
+
+	p.setDown(true)
+	p.spoolContent(content)
+}
+
+func (p *Deliverer) post(content string) error {
+	p.lock_post.Lock()
+	defer p.lock_post.Unlock()
+
+	httpRes, err := p.httpModule.POST(p.Addr,
+		map[string]interface{}{
+			"Content-Type": "application/json",
+		}, content)
+	if err != nil {
+		return err
+	}
+
+	if httpRes.Res != nil && (httpRes.Res.StatusCode < 200 || httpRes.Res.StatusCode >= 300) {
+		return fmt.Errorf("unexpected status code %d: %s", httpRes.Res.StatusCode, httpRes.Body)
+	}
+
+	return nil
+}
+
+func (p *Deliverer) down() bool {
+	p.lock_down.Lock()
+	defer p.lock_down.Unlock()
+
+	return p.isDown
+}
+
+func (p *Deliverer) setDown(down bool) {
+	p.lock_down.Lock()
+	defer p.lock_down.Unlock()
+
+	p.isDown = down
+}
+
+func (p *Deliverer) spool(batch []deliveryItem) {
+	p.spoolContent(p.content(batch))
+}
+
+func (p *Deliverer) spoolContent(content string) {
+	p.lock_spool.Lock()
+	defer p.lock_spool.Unlock()
+
+	// 文件名以时间开头, 按顺序重新发送
+	filename := strconv.FormatInt(time.Now().UnixNano(), 10) + "-" + common.GenerateUniqueStr() + ".json"
+	_, err := common.WriteFile(filepath.Join(p.SpoolDir, filename), []byte(content))
+	if err != nil {
+		log.Println("Spool the results: " + err.Error())
+	}
+}
+
+func (p *Deliverer) spoolFiles() []string {
+	entries, err := ioutil.ReadDir(p.SpoolDir)
+	if err != nil {
+		return nil
+	}
+
+	result := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		result = append(result, filepath.Join(p.SpoolDir, entry.Name()))
+	}
+	sort.Strings(result)
+
+	return result
+}
+
+// 重新发送spool目录中的数据, 全部发送成功后恢复正常发送
+func (p *Deliverer) replay() error {
+	for _, file := range p.spoolFiles() {
+		content, err := common.ReadFileAll(file)
+		if err != nil {
+			continue
+		}
+
+		err = p.post(content)
+		if err != nil {
+			return err
+		}
+
+		os.Remove(file)
+	}
+
+	return nil
+}
+
+func (p *Deliverer) replayLoop() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		// 没有spool数据时也会恢复正常发送, 下一批数据重新尝试
+		p.setDown(p.replay() != nil)
+
+		select {
+		case <-ticker.C:
+		case <-p.closing:
+			return
+		}
+	}
+}
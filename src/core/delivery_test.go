@@ -0,0 +1,262 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 记录收到的批次, failures为前几次请求返回500
+type collector struct {
+	lock     sync.Mutex
+	batches  []RemoteOutputCrawlResult
+	posts    int
+	failures int
+	server   *httptest.Server
+}
+
+func newCollector(failures int) *collector {
+	c := &collector{failures: failures}
+	c.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		c.posts++
+		if c.failures < 0 || c.posts <= c.failures {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		var result RemoteOutputCrawlResult
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &result); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		c.batches = append(c.batches, result)
+	}))
+
+	return c
+}
+
+func (c *collector) links() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var links []string
+	for _, batch := range c.batches {
+		for _, result := range batch.Result {
+			links = append(links, result.Link)
+		}
+	}
+
+	return links
+}
+
+func (c *collector) batchSizes() []int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	sizes := make([]int, len(c.batches))
+	for i, batch := range c.batches {
+		sizes[i] = len(batch.Result)
+	}
+
+	return sizes
+}
+
+func newTestDeliverer(t *testing.T, addr string, batchSize int, maxRetries int, queueSize int) *Deliverer {
+	p := NewDeliverer("test", addr, batchSize, time.Hour, maxRetries, queueSize, t.TempDir())
+	p.retryDelay = 10 * time.Millisecond
+	return p
+}
+
+func testResult(i int) RequestResult {
+	return RequestResult{Method: "GET", Link: fmt.Sprintf("http://example.com/%d", i)}
+}
+
+func spoolCount(t *testing.T, p *Deliverer) int {
+	t.Helper()
+
+	files, err := filepath.Glob(filepath.Join(p.SpoolDir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return len(files)
+}
+
+func TestDelivererBatching(t *testing.T) {
+	c := newCollector(0)
+	defer c.server.Close()
+
+	p := newTestDeliverer(t, c.server.URL, 3, 0, 100)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 7; i++ {
+		p.Push(testResult(i))
+	}
+	p.PushServerCert(ServerCertResult{Host: "example.com"})
+	p.Close()
+
+	// 满一批立即发送, 剩余的在关闭时发送
+	if sizes := fmt.Sprint(c.batchSizes()); sizes != "[3 3 1]" {
+		t.Fatalf("batch sizes = %s, want [3 3 1]", sizes)
+	}
+	links := c.links()
+	for i, link := range links {
+		if link != testResult(i).Link {
+			t.Fatalf("result %d = %s, the order is changed", i, link)
+		}
+	}
+	if hosts := c.batches[2].Hosts; len(hosts) != 1 || hosts[0].Host != "example.com" {
+		t.Fatalf("hosts = %v", hosts)
+	}
+	if n := spoolCount(t, p); n != 0 {
+		t.Fatalf("%d spool files, want 0", n)
+	}
+}
+
+func TestDelivererFlushInterval(t *testing.T) {
+	c := newCollector(0)
+	defer c.server.Close()
+
+	p := newTestDeliverer(t, c.server.URL, 10, 0, 100)
+	p.FlushInterval = 20 * time.Millisecond
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	p.Push(testResult(0))
+	deadline := time.Now().Add(2 * time.Second)
+	for len(c.links()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the result is not flushed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDelivererRetry(t *testing.T) {
+	c := newCollector(2)
+	defer c.server.Close()
+
+	p := newTestDeliverer(t, c.server.URL, 1, 3, 100)
+	p.retryDelay = 50 * time.Millisecond
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	begin := time.Now()
+	p.Push(testResult(0))
+	deadline := time.Now().Add(5 * time.Second)
+	for len(c.links()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the result is not delivered after retries")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	p.Close()
+
+	// 两次失败, 分别等待50ms和100ms
+	if elapsed := time.Since(begin); elapsed < 150*time.Millisecond {
+		t.Fatalf("retried after %v, the backoff is not applied", elapsed)
+	}
+	if c.posts != 3 {
+		t.Fatalf("posted %d times, want 3", c.posts)
+	}
+	if n := spoolCount(t, p); n != 0 {
+		t.Fatalf("%d spool files, want 0", n)
+	}
+}
+
+func TestDelivererSpoolAndReplay(t *testing.T) {
+	c := newCollector(-1)
+	defer c.server.Close()
+
+	p := newTestDeliverer(t, c.server.URL, 2, 1, 100)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		p.Push(testResult(i))
+	}
+	p.Close()
+
+	// 发送失败的批次写入spool
+	if n := spoolCount(t, p); n != 2 {
+		t.Fatalf("%d spool files, want 2", n)
+	}
+	if !p.down() {
+		t.Fatal("the remote address is not marked down")
+	}
+
+	// 远程地址仍然不可用时保留spool文件
+	if err := p.replay(); err == nil {
+		t.Fatal("replay should fail when the remote address is down")
+	}
+	if n := spoolCount(t, p); n != 2 {
+		t.Fatalf("%d spool files after a failed replay, want 2", n)
+	}
+
+	c.lock.Lock()
+	c.failures = 0
+	c.lock.Unlock()
+
+	if err := p.replay(); err != nil {
+		t.Fatal(err)
+	}
+	if n := spoolCount(t, p); n != 0 {
+		t.Fatalf("%d spool files after replay, want 0", n)
+	}
+	links := c.links()
+	if len(links) != 4 {
+		t.Fatalf("replayed %d results, want 4", len(links))
+	}
+	for i, link := range links {
+		if link != testResult(i).Link {
+			t.Fatalf("result %d = %s, the spool files are not replayed in order", i, link)
+		}
+	}
+}
+
+// 队列满时直接写入spool, 不等待发送
+func TestDelivererQueueFull(t *testing.T) {
+	// 不启动发送, 模拟发送卡住时队列不再被取出
+	p := newTestDeliverer(t, "http://127.0.0.1:1", 10, 0, 2)
+
+	begin := time.Now()
+	for i := 0; i < 5; i++ {
+		p.Push(testResult(i))
+	}
+	if elapsed := time.Since(begin); elapsed > 100*time.Millisecond {
+		t.Fatalf("Push blocked for %v", elapsed)
+	}
+
+	if n := len(p.queue); n != 2 {
+		t.Fatalf("%d items in the queue, want 2", n)
+	}
+	if n := spoolCount(t, p); n != 3 {
+		t.Fatalf("%d spool files, want 3", n)
+	}
+}
+
+func TestDelivererDefaultSpoolDir(t *testing.T) {
+	p := NewDeliverer("abc", "http://127.0.0.1:1", 0, 0, 0, 0, "")
+	if p.SpoolDir != DefaultSpoolDir("abc") || filepath.Base(p.SpoolDir) != "abc" {
+		t.Fatalf("spool dir = %s", p.SpoolDir)
+	}
+
+	empty := &Deliverer{}
+	if err := empty.Start(); err == nil {
+		t.Fatal("Start should fail without a spool directory")
+	}
+}
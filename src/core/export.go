@@ -0,0 +1,205 @@
+package core
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"github.com/google/uuid"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"software.sslmate.com/src/go-pkcs12"
+	"strings"
+)
+
+// 导出的CA文件格式
+const (
+	CAFormatPEM          = "pem"
+	CAFormatDER          = "der"
+	CAFormatAndroid      = "android"
+	CAFormatPKCS12       = "p12"
+	CAFormatMobileConfig = "mobileconfig"
+)
+
+// 导出的格式, 文件名和Content-Type
+type CAExportFormat struct {
+	Format      string
+	Description string
+	ContentType string
+}
+
+var CAExportFormats = []CAExportFormat{
+	{CAFormatPEM, "PEM, Linux/Firefox/curl", "application/x-pem-file"},
+	{CAFormatDER, "DER .crt, Windows/Android/Firefox", "application/x-x509-ca-cert"},
+	{CAFormatAndroid, "Android system store, <subject_hash_old>.0", "application/x-pem-file"},
+	{CAFormatPKCS12, "PKCS#12 bundle without the private key, Windows/macOS/Android", "application/x-pkcs12"},
+	{CAFormatMobileConfig, "Apple configuration profile, iOS/macOS", "application/x-apple-aspen-config"},
+}
+
+func CertPEM(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: cert.Raw,
+	})
+}
+
+// 与 openssl x509 -subject_hash_old 相同, Android系统证书目录使用该值作为文件名
+func SubjectHashOld(cert *x509.Certificate) string {
+	h := md5.Sum(cert.RawSubject)
+	return fmt.Sprintf("%08x", binary.LittleEndian.Uint32(h[:4]))
+}
+
+// 冒号分隔的大写十六进制
+func formatFingerprint(sum []byte) string {
+	items := make([]string, len(sum))
+	for i, b := range sum {
+		items[i] = fmt.Sprintf("%02X", b)
+	}
+
+	return strings.Join(items, ":")
+}
+
+func FingerprintSHA1(cert *x509.Certificate) string {
+	h := sha1.Sum(cert.Raw)
+	return formatFingerprint(h[:])
+}
+
+func FingerprintSHA256(cert *x509.Certificate) string {
+	h := sha256.Sum256(cert.Raw)
+	return formatFingerprint(h[:])
+}
+
+// 只包含证书的PKCS#12文件, 不包含私钥
+func CertPKCS12(cert *x509.Certificate, password string) ([]byte, error) {
+	return pkcs12.Modern.EncodeTrustStore([]*x509.Certificate{cert}, password)
+}
+
+func caDisplayName(cert *x509.Certificate) string {
+	if len(cert.Subject.CommonName) > 0 {
+		return cert.Subject.CommonName
+	}
+	if len(cert.Subject.Organization) > 0 {
+		return cert.Subject.Organization[0]
+	}
+
+	return "mitmgo CA"
+}
+
+func xmlEscape(s string) string {
+	buf := new(bytes.Buffer)
+	xml.EscapeText(buf, []byte(s))
+	return buf.String()
+}
+
+// 安装根证书的Apple描述文件
+// UUID由证书指纹生成, 重复安装同一个CA时会替换之前的描述文件
+func CertMobileConfig(cert *x509.Certificate) []byte {
+	name := xmlEscape(caDisplayName(cert))
+	profileUUID := uuid.NewSHA1(uuid.NameSpaceOID, cert.Raw).String()
+	payloadUUID := uuid.NewSHA1(uuid.NameSpaceOID, append([]byte("payload"), cert.Raw...)).String()
+
+	return []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>PayloadContent</key>
+	<array>
+		<dict>
+			<key>PayloadCertificateFileName</key>
+			<string>ca.crt</string>
+			<key>PayloadContent</key>
+			<data>` + base64.StdEncoding.EncodeToString(cert.Raw) + `</data>
+			<key>PayloadDescription</key>
+			<string>Adds a CA root certificate</string>
+			<key>PayloadDisplayName</key>
+			<string>` + name + `</string>
+			<key>PayloadIdentifier</key>
+			<string>com.apple.security.root.` + payloadUUID + `</string>
+			<key>PayloadType</key>
+			<string>com.apple.security.root</string>
+			<key>PayloadUUID</key>
+			<string>` + payloadUUID + `</string>
+			<key>PayloadVersion</key>
+			<integer>1</integer>
+		</dict>
+	</array>
+	<key>PayloadDisplayName</key>
+	<string>` + name + `</string>
+	<key>PayloadIdentifier</key>
+	<string>mitmgo.ca.` + profileUUID + `</string>
+	<key>PayloadRemovalDisallowed</key>
+	<false/>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+	<key>PayloadUUID</key>
+	<string>` + profileUUID + `</string>
+	<key>PayloadVersion</key>
+	<integer>1</integer>
+</dict>
+</plist>
+`)
+}
+
+// 导出的文件名
+func CAExportFileName(cert *x509.Certificate, format string) string {
+	switch format {
+	case CAFormatPEM:
+		return "ca.pem"
+	case CAFormatDER:
+		return "ca.crt"
+	case CAFormatAndroid:
+		return SubjectHashOld(cert) + ".0"
+	case CAFormatPKCS12:
+		return "ca.p12"
+	case CAFormatMobileConfig:
+		return "ca.mobileconfig"
+	}
+
+	return ""
+}
+
+// 按格式导出CA证书, password只用于PKCS#12
+func ExportCA(cert *x509.Certificate, format string, password string) ([]byte, error) {
+	switch format {
+	case CAFormatPEM, CAFormatAndroid:
+		return CertPEM(cert), nil
+	case CAFormatDER:
+		return cert.Raw, nil
+	case CAFormatPKCS12:
+		return CertPKCS12(cert, password)
+	case CAFormatMobileConfig:
+		return CertMobileConfig(cert), nil
+	}
+
+	return nil, fmt.Errorf("unsupported format: %s", format)
+}
+
+// 将CA证书导出为全部格式, 返回保存的文件路径
+func ExportCAFiles(cert *x509.Certificate, dir string, password string) ([]string, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(CAExportFormats))
+	for _, format := range CAExportFormats {
+		content, err := ExportCA(cert, format.Format, password)
+		if err != nil {
+			return nil, err
+		}
+
+		path := filepath.Join(dir, CAExportFileName(cert, format.Format))
+		if err := ioutil.WriteFile(path, content, 0644); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+
+	return paths, nil
+}
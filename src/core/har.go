@@ -0,0 +1,399 @@
+package core
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mitmgo/src/core/common"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// HAR 1.2, 参考 http://www.softwareishard.com/blog/har-12-spec/
+type Har struct {
+	Log HarLog `json:"log"`
+}
+
+type HarLog struct {
+	Version string      `json:"version"`
+	Creator HarCreator  `json:"creator"`
+	Entries []*HarEntry `json:"entries"`
+	Comment string      `json:"comment,omitempty"`
+}
+
+type HarCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HarEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HarRequest  `json:"request"`
+	Response        HarResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HarTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	Comment         string      `json:"comment,omitempty"`
+
+	startTime time.Time
+	size      int64 // 占用内存的估计值
+}
+
+type HarNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HarCookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Expires  string `json:"expires,omitempty"`
+	HTTPOnly bool   `json:"httpOnly,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+}
+
+type HarPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"_encoding,omitempty"` // HAR没有定义请求体的编码, 二进制内容为base64
+}
+
+type HarRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HarCookie    `json:"cookies"`
+	Headers     []HarNameValue `json:"headers"`
+	QueryString []HarNameValue `json:"queryString"`
+	PostData    *HarPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type HarContent struct {
+	Size        int64  `json:"size"`
+	Compression int64  `json:"compression,omitempty"`
+	MimeType    string `json:"mimeType"`
+	Text        string `json:"text,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+	Comment     string `json:"comment,omitempty"`
+}
+
+type HarResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HarCookie    `json:"cookies"`
+	Headers     []HarNameValue `json:"headers"`
+	Content     HarContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+// 单位毫秒, 不可用的阶段为-1
+type HarTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+func harHeaders(header http.Header) []HarNameValue {
+	result := make([]HarNameValue, 0, len(header))
+	keys := make([]string, 0, len(header))
+	for k, _ := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		for _, v := range header[k] {
+			result = append(result, HarNameValue{Name: k, Value: v})
+		}
+	}
+
+	return result
+}
+
+func harCookies(cookies []*http.Cookie) []HarCookie {
+	result := make([]HarCookie, 0, len(cookies))
+	for _, cookie := range cookies {
+		harCookie := HarCookie{
+			Name:     cookie.Name,
+			Value:    cookie.Value,
+			Path:     cookie.Path,
+			Domain:   cookie.Domain,
+			HTTPOnly: cookie.HttpOnly,
+			Secure:   cookie.Secure,
+		}
+		if !cookie.Expires.IsZero() {
+			harCookie.Expires = cookie.Expires.Format(time.RFC3339)
+		}
+		result = append(result, harCookie)
+	}
+
+	return result
+}
+
+func harMilliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// 请求发出时记录的请求信息, body为读取到的请求体
+func NewHarRequest(req *http.Request, body []byte) HarRequest {
+	header := req.Header.Clone()
+	if len(req.Host) > 0 && len(header.Get("Host")) == 0 {
+		header.Set("Host", req.Host)
+	}
+
+	harRequest := HarRequest{
+		Method:      req.Method,
+		URL:         req.URL.String(),
+		HTTPVersion: req.Proto,
+		Cookies:     harCookies(req.Cookies()),
+		Headers:     harHeaders(header),
+		QueryString: make([]HarNameValue, 0),
+		HeadersSize: -1,
+		BodySize:    int64(len(body)),
+	}
+
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k, _ := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range query[k] {
+			harRequest.QueryString = append(harRequest.QueryString, HarNameValue{Name: k, Value: v})
+		}
+	}
+
+	if len(body) > 0 {
+		harRequest.PostData = &HarPostData{
+			MimeType: req.Header.Get("Content-Type"),
+		}
+		if utf8.Valid(body) {
+			harRequest.PostData.Text = string(body)
+		} else {
+			harRequest.PostData.Text = base64.StdEncoding.EncodeToString(body)
+			harRequest.PostData.Encoding = "base64"
+		}
+	}
+
+	return harRequest
+}
+
+// 响应体转发完成后生成响应信息, body为截断后的原始响应体, bodySize为实际长度
+func NewHarResponse(res *http.Response, body []byte, bodySize int64, truncated bool, maxSize int) HarResponse {
+	harResponse := HarResponse{
+		Status:      res.StatusCode,
+		StatusText:  strings.TrimSpace(strings.TrimPrefix(res.Status, strconv.Itoa(res.StatusCode))),
+		HTTPVersion: res.Proto,
+		Cookies:     harCookies(res.Cookies()),
+		Headers:     harHeaders(res.Header),
+		RedirectURL: res.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    bodySize,
+		Content: HarContent{
+			Size:     bodySize,
+			MimeType: res.Header.Get("Content-Type"),
+		},
+	}
+	if len(harResponse.StatusText) == 0 {
+		harResponse.StatusText = http.StatusText(res.StatusCode)
+	}
+	if len(harResponse.HTTPVersion) == 0 {
+		harResponse.HTTPVersion = "HTTP/1.1"
+	}
+
+	// content中保存解压后的内容
+	if !truncated {
+		if decoded, err := common.DecodeContent(body, res.Header.Get("Content-Encoding"), maxSize); err == nil && len(decoded) <= maxSize {
+			harResponse.Content.Size = int64(len(decoded))
+			harResponse.Content.Compression = int64(len(decoded)) - bodySize
+			body = decoded
+		}
+	} else {
+		harResponse.Content.Comment = "content truncated"
+	}
+
+	if len(body) > 0 {
+		if utf8.Valid(body) {
+			harResponse.Content.Text = string(body)
+		} else {
+			harResponse.Content.Text = base64.StdEncoding.EncodeToString(body)
+			harResponse.Content.Encoding = "base64"
+		}
+	}
+
+	return harResponse
+}
+
+// 生成一条记录, wait为发出请求到收到响应头的时间, receive为接收响应体的时间
+func NewHarEntry(startTime time.Time, request HarRequest, response HarResponse, wait time.Duration, receive time.Duration) *HarEntry {
+	entry := &HarEntry{
+		startTime:       startTime,
+		StartedDateTime: startTime.Format(time.RFC3339Nano),
+		Request:         request,
+		Response:        response,
+		Timings: HarTimings{
+			Blocked: -1,
+			DNS:     -1,
+			Connect: -1,
+			Send:    0,
+			Wait:    harMilliseconds(wait),
+			Receive: harMilliseconds(receive),
+			SSL:     -1,
+		},
+	}
+	entry.Time = entry.Timings.Send + entry.Timings.Wait + entry.Timings.Receive
+	entry.size = harEntrySize(entry)
+
+	return entry
+}
+
+// 估算记录占用的内存, 主要是url、头和内容
+func harEntrySize(entry *HarEntry) int64 {
+	size := int64(len(entry.Request.URL))
+	for _, headers := range [][]HarNameValue{entry.Request.Headers, entry.Response.Headers} {
+		for _, header := range headers {
+			size += int64(len(header.Name) + len(header.Value))
+		}
+	}
+	if entry.Request.PostData != nil {
+		size += int64(len(entry.Request.PostData.Text))
+	}
+	size += int64(len(entry.Response.Content.Text))
+
+	return size
+}
+
+// 保存会话中的记录, 超过数量或大小限制时丢弃最早的记录
+type HarRecorder struct {
+	Version    string
+	MaxEntries int   // 最多保存的记录数
+	MaxBytes   int64 // 最多占用的内存
+	entries    []*HarEntry
+	bytes      int64
+	dropped    int64 // 已经丢弃的记录数
+	lock       sync.Mutex
+}
+
+func NewHarRecorder(version string) *HarRecorder {
+	if len(version) == 0 {
+		version = "dev"
+	}
+
+	return &HarRecorder{
+		Version:    version,
+		MaxEntries: 10000,
+		MaxBytes:   256 * 1024 * 1024,
+		entries:    make([]*HarEntry, 0),
+	}
+}
+
+func (p *HarRecorder) Add(entry *HarEntry) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.entries = append(p.entries, entry)
+	p.bytes += entry.size
+
+	// 至少保留最新的一条
+	for len(p.entries) > 1 && ((p.MaxEntries > 0 && len(p.entries) > p.MaxEntries) || (p.MaxBytes > 0 && p.bytes > p.MaxBytes)) {
+		p.bytes -= p.entries[0].size
+		p.entries[0] = nil
+		p.entries = p.entries[1:]
+
+		// 第一次和之后每1000条输出一次
+		if p.dropped%1000 == 0 {
+			log.Printf("the har recorder reached the limit (%d entries, %d bytes), dropped the oldest entries", p.MaxEntries, p.MaxBytes)
+		}
+		p.dropped++
+	}
+}
+
+// 因为超过限制而丢弃的记录数
+func (p *HarRecorder) Dropped() int64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.dropped
+}
+
+func (p *HarRecorder) Count() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return len(p.entries)
+}
+
+// 按开始时间输出当前的所有记录
+func (p *HarRecorder) WriteTo(w io.Writer) (int64, error) {
+	p.lock.Lock()
+	entries := make([]*HarEntry, len(p.entries))
+	copy(entries, p.entries)
+	dropped := p.dropped
+	p.lock.Unlock()
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].startTime.Before(entries[j].startTime)
+	})
+
+	har := Har{
+		Log: HarLog{
+			Version: "1.2",
+			Creator: HarCreator{
+				Name:    "mitmgo",
+				Version: p.Version,
+			},
+			Entries: entries,
+		},
+	}
+	if dropped > 0 {
+		har.Log.Comment = fmt.Sprintf("%d earliest entries are dropped because of the size limit", dropped)
+	}
+
+	buf := new(bytes.Buffer)
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(har)
+	if err != nil {
+		return 0, err
+	}
+
+	return buf.WriteTo(w)
+}
+
+func (p *HarRecorder) SaveFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.WriteTo(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,164 @@
+package core
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testHarEntry(t *testing.T, startTime time.Time, link string, reqBody []byte, resBody []byte) *HarEntry {
+	t.Helper()
+
+	req := httptest.NewRequest("POST", link, bytes.NewReader(reqBody))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+
+	res := &http.Response{
+		StatusCode: 200,
+		Status:     "200 OK",
+		Proto:      "HTTP/1.1",
+		Header:     http.Header{"Content-Type": {"image/png"}},
+	}
+
+	return NewHarEntry(startTime,
+		NewHarRequest(req, reqBody),
+		NewHarResponse(res, resBody, int64(len(resBody)), false, 1024),
+		30*time.Millisecond,
+		5*time.Millisecond)
+}
+
+func decodeHar(t *testing.T, recorder *HarRecorder) *Har {
+	t.Helper()
+
+	buf := new(bytes.Buffer)
+	n, err := recorder.WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Fatalf("WriteTo returned %d, wrote %d bytes", n, buf.Len())
+	}
+
+	var har Har
+	if err := json.Unmarshal(buf.Bytes(), &har); err != nil {
+		t.Fatal(err)
+	}
+
+	return &har
+}
+
+func TestHarRecorderWriteTo(t *testing.T) {
+	recorder := NewHarRecorder("1.0.0")
+	begin := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	binary := []byte{0x89, 'P', 'N', 'G', 0xff, 0x00, 0xfe}
+
+	// 按完成的顺序添加, 输出时按开始时间排序
+	recorder.Add(testHarEntry(t, begin.Add(time.Second), "http://example.com/second?b=2&a=1", []byte("name=value"), []byte("ok")))
+	recorder.Add(testHarEntry(t, begin, "http://example.com/first", binary, binary))
+
+	har := decodeHar(t, recorder)
+	if har.Log.Version != "1.2" || har.Log.Creator.Name != "mitmgo" || har.Log.Creator.Version != "1.0.0" {
+		t.Fatalf("log = %+v", har.Log)
+	}
+	if len(har.Log.Entries) != 2 {
+		t.Fatalf("%d entries, want 2", len(har.Log.Entries))
+	}
+
+	first, second := har.Log.Entries[0], har.Log.Entries[1]
+	if first.Request.URL != "http://example.com/first" || second.Request.URL != "http://example.com/second?b=2&a=1" {
+		t.Fatalf("entries are not sorted by the start time: %s, %s", first.Request.URL, second.Request.URL)
+	}
+	if first.StartedDateTime != begin.Format(time.RFC3339Nano) {
+		t.Fatalf("startedDateTime = %s", first.StartedDateTime)
+	}
+
+	// 二进制内容使用base64
+	if first.Request.PostData == nil || first.Request.PostData.Encoding != "base64" {
+		t.Fatalf("postData = %+v", first.Request.PostData)
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(first.Request.PostData.Text); err != nil || !bytes.Equal(decoded, binary) {
+		t.Fatalf("postData text = %q", first.Request.PostData.Text)
+	}
+	if first.Response.Content.Encoding != "base64" || first.Response.Content.Size != int64(len(binary)) {
+		t.Fatalf("content = %+v", first.Response.Content)
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(first.Response.Content.Text); err != nil || !bytes.Equal(decoded, binary) {
+		t.Fatalf("content text = %q", first.Response.Content.Text)
+	}
+
+	// 文本内容原样保存
+	if second.Request.PostData.Encoding != "" || second.Request.PostData.Text != "name=value" {
+		t.Fatalf("postData = %+v", second.Request.PostData)
+	}
+	if second.Response.Content.Encoding != "" || second.Response.Content.Text != "ok" {
+		t.Fatalf("content = %+v", second.Response.Content)
+	}
+	if query := fmt.Sprint(second.Request.QueryString); query != "[{a 1} {b 2}]" {
+		t.Fatalf("queryString = %s", query)
+	}
+	if cookies := second.Request.Cookies; len(cookies) != 1 || cookies[0].Name != "session" || cookies[0].Value != "abc" {
+		t.Fatalf("cookies = %+v", cookies)
+	}
+	if second.Response.StatusText != "OK" || second.Response.Status != 200 {
+		t.Fatalf("response = %d %s", second.Response.Status, second.Response.StatusText)
+	}
+
+	// 不可用的阶段为-1, 总时间为各阶段之和
+	timings := first.Timings
+	if timings.Blocked != -1 || timings.DNS != -1 || timings.Connect != -1 || timings.SSL != -1 {
+		t.Fatalf("timings = %+v", timings)
+	}
+	if timings.Send != 0 || timings.Wait != 30 || timings.Receive != 5 || first.Time != 35 {
+		t.Fatalf("timings = %+v, time = %v", timings, first.Time)
+	}
+	if len(har.Log.Comment) != 0 {
+		t.Fatalf("comment = %s", har.Log.Comment)
+	}
+}
+
+func TestHarRecorderLimit(t *testing.T) {
+	begin := time.Now()
+
+	recorder := NewHarRecorder("")
+	recorder.MaxEntries = 2
+	for i := 0; i < 5; i++ {
+		recorder.Add(testHarEntry(t, begin.Add(time.Duration(i)*time.Second), fmt.Sprintf("http://example.com/%d", i), nil, []byte("ok")))
+	}
+	if recorder.Count() != 2 || recorder.Dropped() != 3 {
+		t.Fatalf("count = %d, dropped = %d", recorder.Count(), recorder.Dropped())
+	}
+
+	// 丢弃最早的记录
+	har := decodeHar(t, recorder)
+	if har.Log.Entries[0].Request.URL != "http://example.com/3" || har.Log.Entries[1].Request.URL != "http://example.com/4" {
+		t.Fatalf("kept %s and %s", har.Log.Entries[0].Request.URL, har.Log.Entries[1].Request.URL)
+	}
+	if !strings.Contains(har.Log.Comment, "3 earliest entries") {
+		t.Fatalf("comment = %q", har.Log.Comment)
+	}
+
+	// 按大小限制
+	body := bytes.Repeat([]byte("a"), 1000)
+	recorder = NewHarRecorder("")
+	recorder.MaxBytes = 2500
+	for i := 0; i < 4; i++ {
+		recorder.Add(testHarEntry(t, begin, "http://example.com/", nil, body))
+	}
+	if recorder.Count() != 2 || recorder.Dropped() != 2 {
+		t.Fatalf("count = %d, dropped = %d", recorder.Count(), recorder.Dropped())
+	}
+
+	// 单条超过限制时仍然保留最新的一条
+	recorder = NewHarRecorder("")
+	recorder.MaxBytes = 10
+	recorder.Add(testHarEntry(t, begin, "http://example.com/", nil, body))
+	if recorder.Count() != 1 {
+		t.Fatalf("count = %d, want 1", recorder.Count())
+	}
+}
@@ -0,0 +1,167 @@
+package core
+
+import (
+	"fmt"
+	"mitmgo/src/core/common"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// 请求头改写动作
+const (
+	HeaderActionAdd     = "add"     // 追加一个值
+	HeaderActionSet     = "set"     // 覆盖已有的值
+	HeaderActionRemove  = "remove"  // 删除请求头
+	HeaderActionReplace = "replace" // 正则替换已有的值
+)
+
+// 请求头改写规则
+type HeaderRule struct {
+	Action     string   `json:"action"`     // add/set/remove/replace
+	Name       string   `json:"name"`       // 请求头名称
+	Value      string   `json:"value"`      // 值, replace时为替换内容, 支持$1等分组引用
+	Pattern    string   `json:"pattern"`    // replace时使用的正则
+	Hosts      []string `json:"hosts"`      // 生效的host, 为空表示全部, 支持 *.example.com
+	PathPrefix string   `json:"pathPrefix"` // 生效的路径前缀, 为空表示全部
+	Methods    []string `json:"methods"`    // 生效的请求方法, 为空表示全部
+
+	re *regexp.Regexp
+}
+
+type HeaderRuleSet struct {
+	rules []*HeaderRule
+}
+
+// 编译规则, 检查规则是否合法
+func NewHeaderRuleSet(rules []HeaderRule) (*HeaderRuleSet, error) {
+	ruleSet := &HeaderRuleSet{
+		rules: make([]*HeaderRule, 0, len(rules)),
+	}
+
+	for i := range rules {
+		rule := rules[i]
+		rule.Action = strings.ToLower(strings.TrimSpace(rule.Action))
+		rule.Name = http.CanonicalHeaderKey(strings.TrimSpace(rule.Name))
+		if len(rule.Name) == 0 {
+			return nil, fmt.Errorf("header rule %d: name is empty", i)
+		}
+
+		switch rule.Action {
+		case HeaderActionAdd, HeaderActionSet, HeaderActionRemove:
+		case HeaderActionReplace:
+			if len(rule.Pattern) == 0 {
+				return nil, fmt.Errorf("header rule %d: pattern is empty", i)
+			}
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("header rule %d: %v", i, err)
+			}
+			rule.re = re
+		default:
+			return nil, fmt.Errorf("header rule %d: unknown action %q", i, rule.Action)
+		}
+
+		ruleSet.rules = append(ruleSet.rules, &rule)
+	}
+
+	return ruleSet, nil
+}
+
+// 将 --headers 指定的请求头转换为set规则, 只对 --hosts 中的host(包含子域名)生效
+// hosts为空时对全部host生效
+func HeadersToRules(headers map[string]string, hosts []string) []HeaderRule {
+	patterns := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		host = strings.ToLower(common.StripPort(strings.TrimSpace(host)))
+		if len(host) == 0 {
+			continue
+		}
+		if net.ParseIP(host) == nil && !strings.HasPrefix(host, "*.") {
+			host = "*." + host
+		}
+		patterns = append(patterns, host)
+	}
+
+	result := make([]HeaderRule, 0, len(headers))
+	for k, v := range headers {
+		result = append(result, HeaderRule{
+			Action: HeaderActionSet,
+			Name:   k,
+			Value:  v,
+			Hosts:  append([]string{}, patterns...),
+		})
+	}
+
+	return result
+}
+
+func (p *HeaderRule) Match(req *http.Request) bool {
+	if len(p.Methods) > 0 {
+		bFind := false
+		for _, method := range p.Methods {
+			if strings.EqualFold(method, req.Method) {
+				bFind = true
+				break
+			}
+		}
+		if !bFind {
+			return false
+		}
+	}
+
+	if len(p.Hosts) > 0 {
+		host := req.URL.Host
+		if len(host) == 0 {
+			host = req.Host
+		}
+		if !common.MatchHostAny(p.Hosts, host) {
+			return false
+		}
+	}
+
+	if len(p.PathPrefix) > 0 && !strings.HasPrefix(req.URL.Path, p.PathPrefix) {
+		return false
+	}
+
+	return true
+}
+
+// 按顺序对请求应用所有匹配的规则
+func (p *HeaderRuleSet) Apply(req *http.Request) {
+	if p == nil || req == nil || req.URL == nil {
+		return
+	}
+
+	for _, rule := range p.rules {
+		if !rule.Match(req) {
+			continue
+		}
+
+		// Host在net/http中不保存在Header里
+		if rule.Name == "Host" {
+			switch rule.Action {
+			case HeaderActionAdd, HeaderActionSet:
+				req.Host = rule.Value
+			case HeaderActionReplace:
+				req.Host = rule.re.ReplaceAllString(req.Host, rule.Value)
+			}
+			continue
+		}
+
+		switch rule.Action {
+		case HeaderActionAdd:
+			req.Header.Add(rule.Name, rule.Value)
+		case HeaderActionSet:
+			req.Header.Set(rule.Name, rule.Value)
+		case HeaderActionRemove:
+			req.Header.Del(rule.Name)
+		case HeaderActionReplace:
+			values := req.Header[rule.Name]
+			for i, v := range values {
+				values[i] = rule.re.ReplaceAllString(v, rule.Value)
+			}
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package core
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestHeaderRuleSetApply(t *testing.T) {
+	tests := []struct {
+		name   string
+		rules  []HeaderRule
+		method string
+		url    string
+		header http.Header
+		want   http.Header
+		host   string // 为空表示不变
+	}{
+		{
+			name:   "set add remove in order",
+			rules:  []HeaderRule{{Action: "set", Name: "x-token", Value: "a"}, {Action: "add", Name: "X-Token", Value: "b"}, {Action: "remove", Name: "Cookie"}},
+			method: "GET",
+			url:    "http://example.com/",
+			header: http.Header{"X-Token": {"old"}, "Cookie": {"sid=1"}},
+			want:   http.Header{"X-Token": {"a", "b"}},
+		},
+		{
+			name:   "remove then add",
+			rules:  []HeaderRule{{Action: "add", Name: "X-A", Value: "1"}, {Action: "remove", Name: "X-A"}, {Action: "add", Name: "X-A", Value: "2"}},
+			method: "GET",
+			url:    "http://example.com/",
+			header: http.Header{"X-A": {"0"}},
+			want:   http.Header{"X-A": {"2"}},
+		},
+		{
+			name:   "later set overrides",
+			rules:  []HeaderRule{{Action: "set", Name: "Authorization", Value: "Bearer a"}, {Action: " SET ", Name: " authorization ", Value: "Bearer b"}},
+			method: "GET",
+			url:    "http://example.com/",
+			header: http.Header{},
+			want:   http.Header{"Authorization": {"Bearer b"}},
+		},
+		{
+			name:   "replace every value",
+			rules:  []HeaderRule{{Action: "replace", Name: "Cookie", Pattern: `sid=(\w+)`, Value: "sid=${1}x"}},
+			method: "GET",
+			url:    "http://example.com/",
+			header: http.Header{"Cookie": {"sid=1; a=2", "sid=2"}},
+			want:   http.Header{"Cookie": {"sid=1x; a=2", "sid=2x"}},
+		},
+		{
+			name:   "replace missing header",
+			rules:  []HeaderRule{{Action: "replace", Name: "Cookie", Pattern: `.*`, Value: "x"}},
+			method: "GET",
+			url:    "http://example.com/",
+			header: http.Header{},
+			want:   http.Header{},
+		},
+		{
+			name:   "set host",
+			rules:  []HeaderRule{{Action: "set", Name: "host", Value: "internal.example.com"}},
+			method: "GET",
+			url:    "http://example.com/",
+			header: http.Header{},
+			want:   http.Header{},
+			host:   "internal.example.com",
+		},
+		{
+			name:   "replace host",
+			rules:  []HeaderRule{{Action: "replace", Name: "Host", Pattern: `^www\.`, Value: "api."}},
+			method: "GET",
+			url:    "http://www.example.com/",
+			header: http.Header{},
+			want:   http.Header{},
+			host:   "api.example.com",
+		},
+		{
+			name:   "remove host is ignored",
+			rules:  []HeaderRule{{Action: "remove", Name: "Host"}},
+			method: "GET",
+			url:    "http://www.example.com/",
+			header: http.Header{},
+			want:   http.Header{},
+			host:   "www.example.com",
+		},
+		{
+			// 规则按原始URL中的host匹配, 改写Host后不影响后面的规则
+			name:   "match by url host after host is set",
+			rules:  []HeaderRule{{Action: "set", Name: "Host", Value: "other.com"}, {Action: "set", Name: "X-A", Value: "1", Hosts: []string{"example.com"}}},
+			method: "GET",
+			url:    "http://example.com/",
+			header: http.Header{},
+			want:   http.Header{"X-A": {"1"}},
+			host:   "other.com",
+		},
+		{
+			name: "conditions",
+			rules: []HeaderRule{
+				{Action: "set", Name: "X-Host", Value: "1", Hosts: []string{"*.example.com"}},
+				{Action: "set", Name: "X-Other", Value: "1", Hosts: []string{"other.com"}},
+				{Action: "set", Name: "X-Path", Value: "1", PathPrefix: "/api/"},
+				{Action: "set", Name: "X-Admin", Value: "1", PathPrefix: "/admin"},
+				{Action: "set", Name: "X-Post", Value: "1", Methods: []string{"post"}},
+				{Action: "set", Name: "X-Get", Value: "1", Methods: []string{"GET", "HEAD"}},
+			},
+			method: "POST",
+			url:    "https://www.EXAMPLE.com:8443/api/users",
+			header: http.Header{},
+			want:   http.Header{"X-Host": {"1"}, "X-Path": {"1"}, "X-Post": {"1"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ruleSet, err := NewHeaderRuleSet(tt.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(tt.method, tt.url, nil)
+			originalHost := req.Host
+			req.Header = tt.header
+			ruleSet.Apply(req)
+
+			if !reflect.DeepEqual(req.Header, tt.want) {
+				t.Errorf("header = %v, want %v", req.Header, tt.want)
+			}
+			host := tt.host
+			if len(host) == 0 {
+				host = originalHost
+			}
+			if req.Host != host {
+				t.Errorf("host = %q, want %q", req.Host, host)
+			}
+		})
+	}
+
+	// 空的规则集不做处理
+	var empty *HeaderRuleSet
+	empty.Apply(httptest.NewRequest("GET", "http://example.com/", nil))
+}
+
+func TestNewHeaderRuleSetInvalid(t *testing.T) {
+	tests := []HeaderRule{
+		{Action: "set", Name: " "},
+		{Action: "rename", Name: "X-A"},
+		{Action: "", Name: "X-A"},
+		{Action: "replace", Name: "X-A"},
+		{Action: "replace", Name: "X-A", Pattern: "("},
+	}
+
+	for _, rule := range tests {
+		if _, err := NewHeaderRuleSet([]HeaderRule{{Action: "add", Name: "X-B"}, rule}); err == nil {
+			t.Errorf("NewHeaderRuleSet(%+v) should fail", rule)
+		}
+	}
+}
+
+func TestHeadersToRules(t *testing.T) {
+	rules := HeadersToRules(map[string]string{"Cookie": "sid=1", "x-token": "abc"}, []string{" Example.com:8080 ", "*.test.org", "10.0.0.1", ""})
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+
+	hosts := []string{"*.example.com", "*.test.org", "10.0.0.1"}
+	want := []HeaderRule{
+		{Action: HeaderActionSet, Name: "Cookie", Value: "sid=1", Hosts: hosts},
+		{Action: HeaderActionSet, Name: "x-token", Value: "abc", Hosts: hosts},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Fatalf("rules = %+v, want %+v", rules, want)
+	}
+	// 每条规则使用独立的host列表
+	rules[0].Hosts[0] = "changed"
+	if rules[1].Hosts[0] != "*.example.com" {
+		t.Fatal("the rules share the hosts")
+	}
+
+	ruleSet, err := NewHeaderRuleSet(HeadersToRules(map[string]string{"Cookie": "sid=1"}, []string{"example.com", "10.0.0.1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		url    string
+		cookie string
+	}{
+		{"http://example.com/", "sid=1"},
+		{"https://example.com:8443/", "sid=1"},
+		{"http://www.example.com/", "sid=1"},
+		{"http://a.b.example.com/", "sid=1"},
+		{"http://10.0.0.1:8080/", "sid=1"},
+		{"http://notexample.com/", "old"},
+		{"http://example.com.evil.com/", "old"},
+		{"http://10.0.0.2/", "old"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.url, nil)
+		req.Header.Set("Cookie", "old")
+		ruleSet.Apply(req)
+		if cookie := req.Header.Get("Cookie"); cookie != tt.cookie {
+			t.Errorf("%s: cookie = %q, want %q", tt.url, cookie, tt.cookie)
+		}
+	}
+
+	// 没有 --hosts 时对全部host生效
+	ruleSet, err = NewHeaderRuleSet(HeadersToRules(map[string]string{"Cookie": "sid=1"}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "http://any.com/", nil)
+	ruleSet.Apply(req)
+	if cookie := req.Header.Get("Cookie"); cookie != "sid=1" {
+		t.Fatalf("cookie = %q, want sid=1", cookie)
+	}
+}
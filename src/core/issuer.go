@@ -0,0 +1,451 @@
+package core
+
+import (
+	"bytes"
+	"container/list"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"mitmgo/src/core/common"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 证书序列号的上限, 20个字节
+var maxSerialNumber = new(big.Int).Lsh(big.NewInt(1), 159)
+
+// 生成随机的证书序列号
+func RandomSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, maxSerialNumber)
+}
+
+// 使用CA为每个host签发叶子证书, 签发结果保存在内存LRU中, 可选保存到磁盘
+type CertIssuer struct {
+	ca           *x509.Certificate
+	caPriKey     crypto.Signer
+	Validity     time.Duration       // 叶子证书的有效期
+	KeyType      string              // 叶子证书的私钥类型
+	Organization string              // 叶子证书的组织名称
+	CacheSize    int                 // 内存中最多缓存的证书数
+	CacheDir     string              // 磁盘缓存目录, 为空表示不使用
+	Chain        []*x509.Certificate // 中间证书和根证书, 握手时和叶子证书一起发送
+	// 获取上游服务器的证书, 设置后按上游证书仿造叶子证书, 获取失败时使用默认的叶子证书
+	Upstream func(serverName string, addr string) (*x509.Certificate, error)
+
+	lock  sync.Mutex
+	lru   *list.List               // 最近使用的在前
+	cache map[string]*list.Element // host -> *issuedCert
+	// 同一个host同时只签发一次
+	pending map[string]*sync.WaitGroup
+}
+
+type issuedCert struct {
+	host string
+	cert *tls.Certificate
+}
+
+func NewCertIssuer(ca *x509.Certificate, caPriKey crypto.Signer) (*CertIssuer, error) {
+	if ca == nil || caPriKey == nil {
+		return nil, errors.New("the ca and the private key are required")
+	}
+	if !ca.IsCA {
+		return nil, errors.New("the certificate is not a ca")
+	}
+
+	return &CertIssuer{
+		ca:           ca,
+		caPriKey:     caPriKey,
+		Validity:     30 * 24 * time.Hour,
+		KeyType:      KeyTypeECDSAP256,
+		Organization: firstOrEmpty(ca.Subject.Organization),
+		CacheSize:    1024,
+		lru:          list.New(),
+		cache:        make(map[string]*list.Element),
+		pending:      make(map[string]*sync.WaitGroup),
+	}, nil
+}
+
+// 复制CA和签发选项, 使用独立的缓存
+func (p *CertIssuer) Clone() *CertIssuer {
+	return &CertIssuer{
+		ca:           p.ca,
+		caPriKey:     p.caPriKey,
+		Validity:     p.Validity,
+		KeyType:      p.KeyType,
+		Organization: p.Organization,
+		CacheSize:    p.CacheSize,
+		CacheDir:     p.CacheDir,
+		Chain:        p.Chain,
+		Upstream:     p.Upstream,
+		lru:          list.New(),
+		cache:        make(map[string]*list.Element),
+		pending:      make(map[string]*sync.WaitGroup),
+	}
+}
+
+// 用于签发的证书, 使用中间证书签发时为中间证书
+func (p *CertIssuer) CA() *x509.Certificate {
+	return p.ca
+}
+
+// 客户端需要信任的根证书
+func (p *CertIssuer) Root() *x509.Certificate {
+	return RootOf(p.ca, p.Chain)
+}
+
+// 握手时发送的证书链
+func (p *CertIssuer) certificateChain(leaf []byte) [][]byte {
+	chain := make([][]byte, 0, len(p.Chain)+2)
+	chain = append(chain, leaf, p.ca.Raw)
+	for _, cert := range p.Chain {
+		chain = append(chain, cert.Raw)
+	}
+
+	return chain
+}
+
+// 证书是否还能继续使用, 距离过期不足一小时的重新签发
+func (p *CertIssuer) isUsable(cert *tls.Certificate) bool {
+	return cert != nil && cert.Leaf != nil && time.Now().Add(time.Hour).Before(cert.Leaf.NotAfter)
+}
+
+func (p *CertIssuer) getCache(host string) *tls.Certificate {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	elem, ok := p.cache[host]
+	if !ok {
+		return nil
+	}
+
+	item := elem.Value.(*issuedCert)
+	if !p.isUsable(item.cert) {
+		p.lru.Remove(elem)
+		delete(p.cache, host)
+		return nil
+	}
+
+	p.lru.MoveToFront(elem)
+	return item.cert
+}
+
+func (p *CertIssuer) setCache(host string, cert *tls.Certificate) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if elem, ok := p.cache[host]; ok {
+		elem.Value.(*issuedCert).cert = cert
+		p.lru.MoveToFront(elem)
+		return
+	}
+
+	p.cache[host] = p.lru.PushFront(&issuedCert{host: host, cert: cert})
+
+	for p.CacheSize > 0 && p.lru.Len() > p.CacheSize {
+		elem := p.lru.Back()
+		p.lru.Remove(elem)
+		delete(p.cache, elem.Value.(*issuedCert).host)
+	}
+}
+
+// 获取host的证书, 依次查找内存缓存、磁盘缓存, 都没有时签发新证书
+func (p *CertIssuer) Issue(host string) (*tls.Certificate, error) {
+	return p.IssueFor(host, "")
+}
+
+// addr为上游服务器的地址, 仿造上游证书时使用, 为空时使用host的443端口
+func (p *CertIssuer) IssueFor(host string, addr string) (*tls.Certificate, error) {
+	host = strings.ToLower(common.StripPort(strings.TrimSpace(host)))
+	if len(host) == 0 {
+		return nil, errors.New("the host is empty")
+	}
+
+	key := host
+	if p.Upstream != nil {
+		if len(addr) == 0 {
+			addr = net.JoinHostPort(host, "443")
+		}
+		// 仿造时同一个域名的不同端口可能是不同的服务器
+		key = host + "@" + strings.ToLower(addr)
+	}
+
+	for {
+		if cert := p.getCache(key); cert != nil {
+			return cert, nil
+		}
+
+		p.lock.Lock()
+		wg, ok := p.pending[key]
+		if !ok {
+			wg = &sync.WaitGroup{}
+			wg.Add(1)
+			p.pending[key] = wg
+		}
+		p.lock.Unlock()
+
+		// 其他协程正在签发, 等待后重新查找缓存
+		if ok {
+			wg.Wait()
+			continue
+		}
+
+		cert, err := p.issue(key, host, addr)
+
+		p.lock.Lock()
+		delete(p.pending, key)
+		p.lock.Unlock()
+		wg.Done()
+
+		return cert, err
+	}
+}
+
+// key为缓存的key, 不仿造时与host相同
+func (p *CertIssuer) issue(key string, host string, addr string) (*tls.Certificate, error) {
+	if cert := p.loadFromDisk(key, host); cert != nil {
+		p.setCache(key, cert)
+		return cert, nil
+	}
+
+	if p.Upstream != nil {
+		upstream, err := p.Upstream(host, addr)
+		if err == nil {
+			return p.issueMimic(key, upstream)
+		}
+		log.Printf("failed to get the certificate of the upstream server, host: %s, error: %v", addr, err)
+	}
+
+	template := &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:   host,
+			Organization: nameOrEmpty(p.Organization),
+		},
+	}
+	// CN最长64个字符, 以SAN为准
+	if len(host) > 64 {
+		template.Subject.CommonName = ""
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	cert, err := p.Sign(template)
+	if err != nil {
+		return nil, err
+	}
+
+	// 仿造模式下不保存默认的叶子证书, 下次启动时重新获取上游证书
+	if p.Upstream == nil {
+		p.saveToDisk(key, cert)
+	}
+	p.setCache(key, cert)
+
+	return cert, nil
+}
+
+// 复制上游证书的主题、SAN、有效期和密钥用途, 只替换签发者和私钥
+func MimicTemplate(upstream *x509.Certificate) *x509.Certificate {
+	template := &x509.Certificate{
+		RawSubject:         upstream.RawSubject,
+		Subject:            upstream.Subject,
+		DNSNames:           append([]string{}, upstream.DNSNames...),
+		EmailAddresses:     append([]string{}, upstream.EmailAddresses...),
+		IPAddresses:        append([]net.IP{}, upstream.IPAddresses...),
+		URIs:               upstream.URIs,
+		NotBefore:          upstream.NotBefore,
+		NotAfter:           upstream.NotAfter,
+		KeyUsage:           upstream.KeyUsage,
+		ExtKeyUsage:        append([]x509.ExtKeyUsage{}, upstream.ExtKeyUsage...),
+		UnknownExtKeyUsage: upstream.UnknownExtKeyUsage,
+	}
+
+	return template
+}
+
+// 按上游证书仿造叶子证书, 私钥类型与上游证书相同, 不支持的类型使用KeyType
+func (p *CertIssuer) issueMimic(key string, upstream *x509.Certificate) (*tls.Certificate, error) {
+	keyType := PublicKeyType(upstream.PublicKey)
+	if !IsValidKeyType(keyType) {
+		keyType = p.KeyType
+	}
+
+	// 上游证书已过期或即将过期时改用默认有效期, 否则仿造的证书无法缓存, 每次握手都要重新签发
+	template := MimicTemplate(upstream)
+	if !time.Now().Add(time.Hour).Before(template.NotAfter) {
+		template.NotBefore = time.Time{}
+		template.NotAfter = time.Time{}
+	}
+
+	cert, err := p.sign(template, keyType, true)
+	if err != nil {
+		return nil, err
+	}
+
+	p.saveToDisk(key, cert)
+	p.setCache(key, cert)
+
+	return cert, nil
+}
+
+// 使用CA签发证书, template中的序列号、有效期、密钥用途为空时自动填充
+func (p *CertIssuer) Sign(template *x509.Certificate) (*tls.Certificate, error) {
+	return p.sign(template, p.KeyType, false)
+}
+
+// exactUsage为true时不填充默认的密钥用途, 与template保持一致
+func (p *CertIssuer) sign(template *x509.Certificate, keyType string, exactUsage bool) (*tls.Certificate, error) {
+	priv, err := GeneratePrivateKey(keyType)
+	if err != nil {
+		return nil, err
+	}
+
+	if template.SerialNumber == nil {
+		template.SerialNumber, err = RandomSerialNumber()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	template.SubjectKeyId, err = SubjectKeyId(priv.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	// 提前一小时生效, 避免客户端时间误差
+	if template.NotBefore.IsZero() {
+		template.NotBefore = time.Now().Add(-time.Hour)
+	}
+	if template.NotAfter.IsZero() {
+		template.NotAfter = time.Now().Add(p.Validity)
+	}
+	// 不能超过证书链中任何一个证书的有效期
+	for _, cert := range append([]*x509.Certificate{p.ca}, p.Chain...) {
+		if template.NotAfter.After(cert.NotAfter) {
+			template.NotAfter = cert.NotAfter
+		}
+	}
+
+	if template.KeyUsage == 0 && !exactUsage {
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		if _, ok := priv.(*rsa.PrivateKey); ok {
+			template.KeyUsage |= x509.KeyUsageKeyEncipherment
+		}
+	}
+	if len(template.ExtKeyUsage) == 0 && len(template.UnknownExtKeyUsage) == 0 && !exactUsage {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+	template.BasicConstraintsValid = true
+	template.IsCA = false
+
+	raw, err := x509.CreateCertificate(rand.Reader, template, p.ca, priv.Public(), p.caPriKey)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: p.certificateChain(raw),
+		PrivateKey:  priv,
+		Leaf:        leaf,
+	}, nil
+}
+
+// 握手时按SNI获取证书, 没有SNI时使用defaultHost, defaultHost为CONNECT的目标地址
+func (p *CertIssuer) TLSConfig(defaultHost string) *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			host := hello.ServerName
+			if len(host) == 0 {
+				host = defaultHost
+			}
+
+			return p.IssueFor(host, defaultHost)
+		},
+		NextProtos: []string{"http/1.1"},
+	}
+}
+
+func (p *CertIssuer) diskCachePath(key string) string {
+	// key中只会有字母、数字、点、横线、冒号(IPv6)和@
+	name := strings.NewReplacer(":", "_", "/", "_", "\\", "_", "*", "_").Replace(key)
+	// 仿造的证书与默认的证书分开保存
+	if p.Upstream != nil {
+		name += ".mimic"
+	}
+	return filepath.Join(p.CacheDir, name+".pem")
+}
+
+func (p *CertIssuer) loadFromDisk(key string, host string) *tls.Certificate {
+	if len(p.CacheDir) == 0 {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(p.diskCachePath(key))
+	if err != nil {
+		return nil
+	}
+
+	cert, err := tls.X509KeyPair(content, content)
+	if err != nil {
+		return nil
+	}
+
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil
+	}
+
+	// 必须是当前CA签发的, 并且没有过期
+	if err := cert.Leaf.CheckSignatureFrom(p.ca); err != nil || !p.isUsable(&cert) {
+		return nil
+	}
+	// 仿造的证书与上游证书相同, 不一定包含host
+	if err := cert.Leaf.VerifyHostname(host); err != nil && p.Upstream == nil {
+		return nil
+	}
+
+	cert.Certificate = p.certificateChain(cert.Certificate[0])
+
+	return &cert
+}
+
+func (p *CertIssuer) saveToDisk(key string, cert *tls.Certificate) {
+	if len(p.CacheDir) == 0 {
+		return
+	}
+
+	keyPEM, err := MarshalPrivateKeyPEM(cert.PrivateKey.(crypto.Signer))
+	if err != nil {
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	pem.Encode(buf, &pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: cert.Certificate[0],
+	})
+	buf.Write(keyPEM)
+
+	if err := os.MkdirAll(p.CacheDir, 0700); err != nil {
+		return
+	}
+	ioutil.WriteFile(p.diskCachePath(key), buf.Bytes(), 0600)
+}
@@ -0,0 +1,279 @@
+package core
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 生成测试用的CA, 使用ECDSA加快生成速度
+func newTestCA(t *testing.T) *CAMaterial {
+	t.Helper()
+
+	opts := NewCAOptions()
+	opts.KeyType = KeyTypeECDSAP256
+	certPEM, keyPEM, err := GenerateCA(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	material, err := ParseCA(certPEM, keyPEM, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return material
+}
+
+func newTestIssuer(t *testing.T, material *CAMaterial) *CertIssuer {
+	t.Helper()
+
+	issuer, err := NewCertIssuer(material.Cert, material.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return issuer
+}
+
+func TestIssueForSANs(t *testing.T) {
+	material := newTestCA(t)
+	issuer := newTestIssuer(t, material)
+	roots := x509.NewCertPool()
+	roots.AddCert(material.Cert)
+	longHost := strings.Repeat("a", 60) + ".example.com"
+
+	tests := []struct {
+		host       string
+		commonName string
+		dnsNames   []string
+		ip         string
+	}{
+		{"www.example.com", "www.example.com", []string{"www.example.com"}, ""},
+		{" WWW.Example.COM:8443 ", "www.example.com", []string{"www.example.com"}, ""},
+		{"10.0.0.1", "10.0.0.1", nil, "10.0.0.1"},
+		{"10.0.0.1:443", "10.0.0.1", nil, "10.0.0.1"},
+		{"[2001:db8::1]:443", "2001:db8::1", nil, "2001:db8::1"},
+		{longHost, "", []string{longHost}, ""},
+	}
+
+	for _, tt := range tests {
+		cert, err := issuer.IssueFor(tt.host, "")
+		if err != nil {
+			t.Fatalf("IssueFor(%q): %v", tt.host, err)
+		}
+		leaf := cert.Leaf
+		if leaf.Subject.CommonName != tt.commonName {
+			t.Errorf("IssueFor(%q): CN = %q, want %q", tt.host, leaf.Subject.CommonName, tt.commonName)
+		}
+		if len(leaf.DNSNames) != len(tt.dnsNames) || (len(tt.dnsNames) > 0 && leaf.DNSNames[0] != tt.dnsNames[0]) {
+			t.Errorf("IssueFor(%q): DNS SANs = %v, want %v", tt.host, leaf.DNSNames, tt.dnsNames)
+		}
+		if len(tt.ip) > 0 {
+			if len(leaf.IPAddresses) != 1 || !leaf.IPAddresses[0].Equal(net.ParseIP(tt.ip)) {
+				t.Errorf("IssueFor(%q): IP SANs = %v, want %s", tt.host, leaf.IPAddresses, tt.ip)
+			}
+		} else if len(leaf.IPAddresses) != 0 {
+			t.Errorf("IssueFor(%q): IP SANs = %v", tt.host, leaf.IPAddresses)
+		}
+
+		// 客户端信任CA后可以验证通过
+		name := tt.ip
+		if len(name) == 0 {
+			name = tt.dnsNames[0]
+		}
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: roots}); err != nil {
+			t.Errorf("IssueFor(%q): %v", tt.host, err)
+		}
+		if len(cert.Certificate) != 2 {
+			t.Errorf("IssueFor(%q): the chain has %d certificates, want 2", tt.host, len(cert.Certificate))
+		}
+	}
+
+	if _, err := issuer.IssueFor(" ", ""); err == nil {
+		t.Error("IssueFor with an empty host should fail")
+	}
+}
+
+func TestIssueForRandomSerial(t *testing.T) {
+	issuer := newTestIssuer(t, newTestCA(t))
+
+	serials := make(map[string]struct{})
+	for _, host := range []string{"a.example.com", "b.example.com", "c.example.com", "d.example.com"} {
+		cert, err := issuer.Issue(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serial := cert.Leaf.SerialNumber
+		if serial.Sign() <= 0 || serial.BitLen() > 159 {
+			t.Fatalf("serial = %s", serial)
+		}
+		if _, ok := serials[serial.String()]; ok {
+			t.Fatalf("serial %s is used twice", serial)
+		}
+		serials[serial.String()] = struct{}{}
+	}
+}
+
+// 同一个host并发签发时只签发一次
+func TestIssueForSingleFlight(t *testing.T) {
+	issuer := newTestIssuer(t, newTestCA(t))
+
+	// 获取上游证书失败时使用默认证书, 用调用次数统计签发次数
+	var calls int32
+	issuer.Upstream = func(serverName string, addr string) (*x509.Certificate, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(50 * time.Millisecond)
+		return nil, errors.New("unreachable")
+	}
+
+	const n = 20
+	certs := make([]*tls.Certificate, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cert, err := issuer.IssueFor("www.example.com", "10.0.0.1:443")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			certs[i] = cert
+		}(i)
+	}
+	wg.Wait()
+
+	if calls != 1 {
+		t.Fatalf("issued %d times, want 1", calls)
+	}
+	for i := 1; i < n; i++ {
+		if certs[i] != certs[0] {
+			t.Fatal("the concurrent calls got different certificates")
+		}
+	}
+
+	// 仿造时不同的上游地址分别签发
+	if _, err := issuer.IssueFor("www.example.com", "10.0.0.2:443"); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Fatalf("issued %d times, want 2", calls)
+	}
+}
+
+func TestIssueForLRU(t *testing.T) {
+	issuer := newTestIssuer(t, newTestCA(t))
+	issuer.CacheSize = 2
+
+	issue := func(host string) *tls.Certificate {
+		cert, err := issuer.Issue(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+
+	a := issue("a.example.com")
+	b := issue("b.example.com")
+	if issue("a.example.com") != a {
+		t.Fatal("a.example.com is not cached")
+	}
+
+	// a最近使用过, 淘汰b
+	issue("c.example.com")
+	if issuer.lru.Len() != 2 {
+		t.Fatalf("%d cached certificates, want 2", issuer.lru.Len())
+	}
+	if issue("a.example.com") != a {
+		t.Fatal("the recently used certificate is evicted")
+	}
+	if issue("b.example.com") == b {
+		t.Fatal("the least recently used certificate is not evicted")
+	}
+}
+
+func TestIssueForDiskCache(t *testing.T) {
+	material := newTestCA(t)
+	issuer := newTestIssuer(t, material)
+	issuer.CacheDir = t.TempDir()
+
+	cert, err := issuer.Issue("www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(issuer.diskCachePath("www.example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重启后从磁盘加载
+	reloaded, err := issuer.Clone().Issue("www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded == cert || reloaded.Leaf.SerialNumber.Cmp(cert.Leaf.SerialNumber) != 0 {
+		t.Fatal("the certificate is not loaded from the disk cache")
+	}
+	if len(reloaded.Certificate) != 2 || reloaded.PrivateKey == nil {
+		t.Fatalf("the reloaded certificate has %d certificates", len(reloaded.Certificate))
+	}
+
+	// 其他CA签发的不使用
+	other := newTestIssuer(t, newTestCA(t))
+	other.CacheDir = issuer.CacheDir
+	cert, err = other.Issue("www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf.SerialNumber.Cmp(reloaded.Leaf.SerialNumber) == 0 {
+		t.Fatal("loaded a certificate issued by another ca")
+	}
+
+	// 损坏的文件重新签发
+	if err := os.WriteFile(issuer.diskCachePath("broken.example.com"), []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err = issuer.Clone().Issue("broken.example.com")
+	if err != nil || cert.Leaf.DNSNames[0] != "broken.example.com" {
+		t.Fatalf("cert = %v, err = %v", cert, err)
+	}
+}
+
+// 同一个CA多次调用共用签发器
+func TestSignUrlByCA(t *testing.T) {
+	material := newTestCA(t)
+
+	certPEM, keyPEM, err := SignUrlByCA(material.Cert, material.Key, "https://www.example.com:8443/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaf.DNSNames) != 1 || leaf.DNSNames[0] != "www.example.com" {
+		t.Fatalf("DNS SANs = %v", leaf.DNSNames)
+	}
+
+	again, _, err := SignUrlByCA(material.Cert, material.Key, "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(again) != string(certPEM) {
+		t.Fatal("the issuer of the ca is not reused")
+	}
+
+	if _, _, err := SignUrlByCA(nil, material.Key, "www.example.com"); err == nil {
+		t.Fatal("SignUrlByCA without a ca should fail")
+	}
+}
@@ -0,0 +1,142 @@
+package core
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// 私钥类型
+const (
+	KeyTypeRSA2048   = "rsa2048"
+	KeyTypeRSA3072   = "rsa3072"
+	KeyTypeRSA4096   = "rsa4096"
+	KeyTypeECDSAP256 = "ecdsa-p256"
+	KeyTypeECDSAP384 = "ecdsa-p384"
+	KeyTypeEd25519   = "ed25519"
+)
+
+// 支持的私钥类型, 用于命令行帮助
+var KeyTypes = []string{
+	KeyTypeRSA2048,
+	KeyTypeRSA3072,
+	KeyTypeRSA4096,
+	KeyTypeECDSAP256,
+	KeyTypeECDSAP384,
+	KeyTypeEd25519,
+}
+
+// 生成指定类型的私钥, 为空时使用ECDSA P-256
+func GeneratePrivateKey(keyType string) (crypto.Signer, error) {
+	switch strings.ToLower(strings.TrimSpace(keyType)) {
+	case KeyTypeRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyTypeRSA3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case KeyTypeRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case "", KeyTypeECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyTypeEd25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return priv, nil
+	}
+
+	return nil, errors.New("unsupported key type: " + keyType + ", available: " + strings.Join(KeyTypes, ", "))
+}
+
+// 检查私钥类型是否支持
+func IsValidKeyType(keyType string) bool {
+	keyType = strings.ToLower(strings.TrimSpace(keyType))
+	if len(keyType) == 0 {
+		return true
+	}
+
+	for _, k := range KeyTypes {
+		if k == keyType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// 使用PKCS#8格式编码私钥
+func MarshalPrivateKeyPEM(priv crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: der,
+	}), nil
+}
+
+// 解析DER编码的私钥, 支持PKCS#8、PKCS#1和SEC1(EC)格式
+func ParsePrivateKeyDER(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("unsupported private key")
+		}
+		return signer, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+
+	return nil, errors.New("failed to parse the private key")
+}
+
+// 根据公钥计算SubjectKeyId, https://www.ietf.org/rfc/rfc3280.txt (section 4.2.1.2)
+func SubjectKeyId(pub crypto.PublicKey) ([]byte, error) {
+	pkixpub, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha1.Sum(pkixpub)
+	return h[:], nil
+}
+
+// 公钥类型, RSA包含长度, 例如 rsa2048、ecdsa-p256, 支持的类型与KeyTypes中的名称一致
+// 私钥使用 priv.Public() 获取类型
+func PublicKeyType(pub crypto.PublicKey) string {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("rsa%d", k.N.BitLen())
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return KeyTypeECDSAP256
+		case elliptic.P384():
+			return KeyTypeECDSAP384
+		case elliptic.P521():
+			return "ecdsa-p521"
+		}
+		return "ecdsa"
+	case ed25519.PublicKey:
+		return KeyTypeEd25519
+	}
+
+	return "unknown"
+}
@@ -0,0 +1,371 @@
+package core
+
+import (
+	"fmt"
+	"mitmgo/src/core/common"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// 范围规则, 规则内不为空的条件需要同时满足, 同一条件中的多个值满足任一即可
+type ScopeRule struct {
+	Hosts      []string `json:"hosts"`      // host通配符, 例如 *.example.com
+	CIDRs      []string `json:"cidrs"`      // IP或者CIDR, 只匹配直接使用IP访问的请求
+	Ports      []string `json:"ports"`      // 端口或端口范围, 例如 443, 8000-8100
+	Paths      []string `json:"paths"`      // 路径通配符, * 不匹配 /, ** 匹配任意字符
+	PathRegex  string   `json:"pathRegex"`  // 路径正则
+	URLRegex   string   `json:"urlRegex"`   // 完整url的正则
+	Keywords   []string `json:"keywords"`   // url中包含的关键词
+	Methods    []string `json:"methods"`    // 请求方法
+	Extensions []string `json:"extensions"` // 文件扩展名, 不带点
+}
+
+// 包含和排除规则, 排除规则优先; 没有包含规则时表示全部包含
+type ScopeConfig struct {
+	Include []ScopeRule `json:"include"`
+	Exclude []ScopeRule `json:"exclude"`
+}
+
+type portRange struct {
+	begin int
+	end   int
+}
+
+type scopeMatcher struct {
+	rule      ScopeRule
+	nets      []*net.IPNet
+	ports     []portRange
+	paths     []*regexp.Regexp
+	pathRegex *regexp.Regexp
+	urlRegex  *regexp.Regexp
+}
+
+type Scope struct {
+	include []*scopeMatcher
+	exclude []*scopeMatcher
+}
+
+func NewScopeConfig() *ScopeConfig {
+	return &ScopeConfig{
+		Include: []ScopeRule{},
+		Exclude: []ScopeRule{},
+	}
+}
+
+// 将 --hosts 和 --ignore-words 转换为范围规则
+// --hosts 中的域名同时包含其子域名, 带端口时只匹配该端口
+func ScopeConfigFromFlags(hosts []string, ignoreWords []string) *ScopeConfig {
+	config := NewScopeConfig()
+
+	for _, host := range hosts {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if len(host) == 0 {
+			continue
+		}
+
+		rule := ScopeRule{}
+		if h, port, err := net.SplitHostPort(host); err == nil {
+			host = h
+			rule.Ports = []string{port}
+		}
+
+		if ip := net.ParseIP(host); ip != nil {
+			rule.CIDRs = []string{host}
+		} else if strings.HasPrefix(host, "*.") {
+			rule.Hosts = []string{host}
+		} else {
+			rule.Hosts = []string{host, "*." + host}
+		}
+
+		config.Include = append(config.Include, rule)
+	}
+
+	if len(ignoreWords) > 0 {
+		config.Exclude = append(config.Exclude, ScopeRule{
+			Keywords: append([]string{}, ignoreWords...),
+		})
+	}
+
+	return config
+}
+
+// 合并另一个配置中的规则
+func (p *ScopeConfig) Merge(other *ScopeConfig) {
+	if other == nil {
+		return
+	}
+
+	p.Include = append(p.Include, other.Include...)
+	p.Exclude = append(p.Exclude, other.Exclude...)
+}
+
+// 将路径通配符转换为正则
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	var buf strings.Builder
+	buf.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				buf.WriteString(".*")
+				i++
+			} else {
+				buf.WriteString("[^/]*")
+			}
+		case '?':
+			buf.WriteString("[^/]")
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	buf.WriteString("$")
+
+	return regexp.Compile(buf.String())
+}
+
+func newScopeMatcher(rule ScopeRule) (*scopeMatcher, error) {
+	matcher := &scopeMatcher{
+		rule: rule,
+	}
+
+	for _, cidr := range rule.CIDRs {
+		ipnet, err := common.ParseIPNet(cidr)
+		if err != nil {
+			return nil, err
+		}
+		matcher.nets = append(matcher.nets, ipnet)
+	}
+
+	for _, port := range rule.Ports {
+		var r portRange
+		var err error
+		items := strings.SplitN(strings.TrimSpace(port), "-", 2)
+		r.begin, err = strconv.Atoi(items[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid port: %s", port)
+		}
+		r.end = r.begin
+		if len(items) == 2 {
+			r.end, err = strconv.Atoi(items[1])
+			if err != nil || r.end < r.begin {
+				return nil, fmt.Errorf("invalid port range: %s", port)
+			}
+		}
+		matcher.ports = append(matcher.ports, r)
+	}
+
+	for _, glob := range rule.Paths {
+		re, err := globToRegexp(glob)
+		if err != nil {
+			return nil, err
+		}
+		matcher.paths = append(matcher.paths, re)
+	}
+
+	var err error
+	if len(rule.PathRegex) > 0 {
+		matcher.pathRegex, err = regexp.Compile(rule.PathRegex)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(rule.URLRegex) > 0 {
+		matcher.urlRegex, err = regexp.Compile(rule.URLRegex)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// 复制一份, 不修改调用者传入的规则
+	matcher.rule.Extensions = make([]string, 0, len(rule.Extensions))
+	for _, ext := range rule.Extensions {
+		matcher.rule.Extensions = append(matcher.rule.Extensions, strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), ".")))
+	}
+
+	return matcher, nil
+}
+
+// 请求的端口, 没有指定时按scheme取默认端口
+func requestPort(req *http.Request) int {
+	if _, port, err := net.SplitHostPort(req.URL.Host); err == nil {
+		if n, err := strconv.Atoi(port); err == nil {
+			return n
+		}
+	}
+
+	if req.URL.Scheme == "https" || req.URL.Scheme == "wss" || req.Method == "CONNECT" {
+		return 443
+	}
+
+	return 80
+}
+
+func (p *scopeMatcher) match(req *http.Request) bool {
+	host := req.URL.Host
+	if len(host) == 0 {
+		host = req.Host
+	}
+	hostname := strings.ToLower(common.StripPort(host))
+
+	if len(p.rule.Hosts) > 0 && !common.MatchHostAny(p.rule.Hosts, hostname) {
+		return false
+	}
+
+	if len(p.nets) > 0 {
+		ip := net.ParseIP(hostname)
+		if ip == nil {
+			return false
+		}
+		bFind := false
+		for _, ipnet := range p.nets {
+			if ipnet.Contains(ip) {
+				bFind = true
+				break
+			}
+		}
+		if !bFind {
+			return false
+		}
+	}
+
+	if len(p.ports) > 0 {
+		port := requestPort(req)
+		bFind := false
+		for _, r := range p.ports {
+			if port >= r.begin && port <= r.end {
+				bFind = true
+				break
+			}
+		}
+		if !bFind {
+			return false
+		}
+	}
+
+	if len(p.rule.Methods) > 0 {
+		bFind := false
+		for _, method := range p.rule.Methods {
+			if strings.EqualFold(method, req.Method) {
+				bFind = true
+				break
+			}
+		}
+		if !bFind {
+			return false
+		}
+	}
+
+	urlPath := req.URL.Path
+	if len(urlPath) == 0 {
+		urlPath = "/"
+	}
+
+	if len(p.paths) > 0 {
+		bFind := false
+		for _, re := range p.paths {
+			if re.MatchString(urlPath) {
+				bFind = true
+				break
+			}
+		}
+		if !bFind {
+			return false
+		}
+	}
+
+	if p.pathRegex != nil && !p.pathRegex.MatchString(urlPath) {
+		return false
+	}
+
+	if p.urlRegex != nil && !p.urlRegex.MatchString(req.URL.String()) {
+		return false
+	}
+
+	if len(p.rule.Keywords) > 0 {
+		link := req.URL.String()
+		bFind := false
+		for _, word := range p.rule.Keywords {
+			if strings.Contains(link, word) {
+				bFind = true
+				break
+			}
+		}
+		if !bFind {
+			return false
+		}
+	}
+
+	if len(p.rule.Extensions) > 0 {
+		ext := strings.ToLower(strings.TrimPrefix(path.Ext(urlPath), "."))
+		bFind := false
+		for _, e := range p.rule.Extensions {
+			if e == ext {
+				bFind = true
+				break
+			}
+		}
+		if !bFind {
+			return false
+		}
+	}
+
+	return true
+}
+
+func NewScope(config *ScopeConfig) (*Scope, error) {
+	scope := &Scope{
+		include: make([]*scopeMatcher, 0),
+		exclude: make([]*scopeMatcher, 0),
+	}
+	if config == nil {
+		return scope, nil
+	}
+
+	for i, rule := range config.Include {
+		matcher, err := newScopeMatcher(rule)
+		if err != nil {
+			return nil, fmt.Errorf("scope include rule %d: %v", i, err)
+		}
+		scope.include = append(scope.include, matcher)
+	}
+
+	for i, rule := range config.Exclude {
+		matcher, err := newScopeMatcher(rule)
+		if err != nil {
+			return nil, fmt.Errorf("scope exclude rule %d: %v", i, err)
+		}
+		scope.exclude = append(scope.exclude, matcher)
+	}
+
+	return scope, nil
+}
+
+// 判断请求是否在范围内, 排除规则优先
+func (p *Scope) InScope(req *http.Request) bool {
+	if p == nil || req == nil || req.URL == nil {
+		return true
+	}
+
+	for _, matcher := range p.exclude {
+		if matcher.match(req) {
+			return false
+		}
+	}
+
+	if len(p.include) == 0 {
+		return true
+	}
+
+	for _, matcher := range p.include {
+		if matcher.match(req) {
+			return true
+		}
+	}
+
+	return false
+}
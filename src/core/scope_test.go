@@ -0,0 +1,329 @@
+package core
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestScopeInScope(t *testing.T) {
+	type request struct {
+		method string
+		url    string
+		in     bool
+	}
+	tests := []struct {
+		name     string
+		config   *ScopeConfig
+		requests []request
+	}{
+		{
+			name:   "empty config includes all",
+			config: NewScopeConfig(),
+			requests: []request{
+				{"GET", "http://example.com/", true},
+				{"POST", "https://10.0.0.1:8443/api", true},
+			},
+		},
+		{
+			name: "exclude takes precedence",
+			config: &ScopeConfig{
+				Include: []ScopeRule{{Hosts: []string{"*.example.com"}}},
+				Exclude: []ScopeRule{{Hosts: []string{"static.example.com"}}, {Paths: []string{"/logout"}}},
+			},
+			requests: []request{
+				{"GET", "http://www.example.com/", true},
+				{"GET", "http://example.com/", true},
+				{"GET", "http://static.example.com/a.js", false},
+				{"GET", "http://www.example.com/logout", false},
+				{"GET", "http://www.other.com/", false},
+			},
+		},
+		{
+			name: "only exclude",
+			config: &ScopeConfig{
+				Exclude: []ScopeRule{{Methods: []string{"options"}}},
+			},
+			requests: []request{
+				{"GET", "http://example.com/", true},
+				{"OPTIONS", "http://example.com/", false},
+			},
+		},
+		{
+			name: "all conditions of a rule",
+			config: &ScopeConfig{
+				Include: []ScopeRule{{Hosts: []string{"api.example.com"}, Methods: []string{"POST", "PUT"}, Paths: []string{"/v1/**"}}},
+			},
+			requests: []request{
+				{"POST", "https://api.example.com/v1/users", true},
+				{"put", "https://api.example.com/v1/users/1", true},
+				{"GET", "https://api.example.com/v1/users", false},
+				{"POST", "https://api.example.com/v2/users", false},
+				{"POST", "https://www.example.com/v1/users", false},
+			},
+		},
+		{
+			name: "any rule of the include",
+			config: &ScopeConfig{
+				Include: []ScopeRule{{Hosts: []string{"a.com"}}, {Hosts: []string{"b.com"}}},
+			},
+			requests: []request{
+				{"GET", "http://a.com/", true},
+				{"GET", "http://b.com/", true},
+				{"GET", "http://c.com/", false},
+			},
+		},
+		{
+			name: "path globs",
+			config: &ScopeConfig{
+				Include: []ScopeRule{{Paths: []string{"/api/*/detail", "/static/**", "/file?.txt"}}},
+			},
+			requests: []request{
+				{"GET", "http://example.com/api/users/detail", true},
+				{"GET", "http://example.com/api/users/1/detail", false},
+				{"GET", "http://example.com/static/", true},
+				{"GET", "http://example.com/static/js/app/main.js", true},
+				{"GET", "http://example.com/static", false},
+				{"GET", "http://example.com/file1.txt", true},
+				{"GET", "http://example.com/file12.txt", false},
+				{"GET", "http://example.com/file/.txt", false},
+				{"GET", "http://example.com/api.users/detail", false},
+			},
+		},
+		{
+			name: "glob special characters",
+			config: &ScopeConfig{
+				Include: []ScopeRule{{Paths: []string{"/a+b/(x)"}}},
+			},
+			requests: []request{
+				{"GET", "http://example.com/a+b/(x)", true},
+				{"GET", "http://example.com/aab/x", false},
+			},
+		},
+		{
+			name: "cidrs",
+			config: &ScopeConfig{
+				Include: []ScopeRule{{CIDRs: []string{"10.0.0.0/8", "192.168.1.10", "2001:db8::/32"}}},
+			},
+			requests: []request{
+				{"GET", "http://10.1.2.3/", true},
+				{"GET", "https://10.1.2.3:8443/x", true},
+				{"GET", "http://192.168.1.10/", true},
+				{"GET", "http://192.168.1.11/", false},
+				{"GET", "http://[2001:db8::1]:8080/", true},
+				{"GET", "http://[2001:db9::1]/", false},
+				{"GET", "http://internal.example.com/", false},
+			},
+		},
+		{
+			name: "ports",
+			config: &ScopeConfig{
+				Include: []ScopeRule{{Ports: []string{"443", "8000-8100"}}},
+			},
+			requests: []request{
+				{"GET", "https://example.com/", true},
+				{"GET", "http://example.com/", false},
+				{"GET", "http://example.com:443/", true},
+				{"GET", "http://example.com:8000/", true},
+				{"GET", "http://example.com:8100/", true},
+				{"GET", "http://example.com:8101/", false},
+				{"GET", "wss://example.com/socket", true},
+			},
+		},
+		{
+			name: "path and url regex",
+			config: &ScopeConfig{
+				Include: []ScopeRule{{PathRegex: `^/api/v[0-9]+/`, URLRegex: `^https://`}},
+			},
+			requests: []request{
+				{"GET", "https://example.com/api/v2/users", true},
+				{"GET", "http://example.com/api/v2/users", false},
+				{"GET", "https://example.com/api/vx/users", false},
+			},
+		},
+		{
+			name: "url regex with query",
+			config: &ScopeConfig{
+				Exclude: []ScopeRule{{URLRegex: `[?&]debug=1`}},
+			},
+			requests: []request{
+				{"GET", "http://example.com/?debug=1", false},
+				{"GET", "http://example.com/?a=2&debug=1", false},
+				{"GET", "http://example.com/?debug=0", true},
+			},
+		},
+		{
+			name: "extensions",
+			config: &ScopeConfig{
+				Exclude: []ScopeRule{{Extensions: []string{"PNG", ".css", " js "}}},
+			},
+			requests: []request{
+				{"GET", "http://example.com/a.png", false},
+				{"GET", "http://example.com/a.PNG", false},
+				{"GET", "http://example.com/b.css?v=1", false},
+				{"GET", "http://example.com/app.js", false},
+				{"GET", "http://example.com/api.json", true},
+				{"GET", "http://example.com/js", true},
+			},
+		},
+		{
+			name: "keywords",
+			config: &ScopeConfig{
+				Exclude: []ScopeRule{{Keywords: []string{"logout", "google-analytics"}}},
+			},
+			requests: []request{
+				{"GET", "http://example.com/user/logout", false},
+				{"GET", "http://www.google-analytics.com/collect", false},
+				{"GET", "http://example.com/login", true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scope, err := NewScope(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range tt.requests {
+				req := httptest.NewRequest(r.method, r.url, nil)
+				if in := scope.InScope(req); in != r.in {
+					t.Errorf("%s %s: InScope = %v, want %v", r.method, r.url, in, r.in)
+				}
+			}
+		})
+	}
+}
+
+// CONNECT请求只有host和端口, 端口默认为443
+func TestScopeConnect(t *testing.T) {
+	scope, err := NewScope(&ScopeConfig{Include: []ScopeRule{{Hosts: []string{"example.com"}, Ports: []string{"443"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host string
+		in   bool
+	}{
+		{"example.com:443", true},
+		{"example.com", true},
+		{"example.com:8443", false},
+		{"other.com:443", false},
+	}
+	for _, tt := range tests {
+		req := &http.Request{Method: "CONNECT", URL: &url.URL{Host: tt.host}, Host: tt.host}
+		if in := scope.InScope(req); in != tt.in {
+			t.Errorf("CONNECT %s: InScope = %v, want %v", tt.host, in, tt.in)
+		}
+	}
+
+	// 没有范围时全部包含
+	var empty *Scope
+	if !empty.InScope(&http.Request{Method: "GET", URL: &url.URL{Host: "example.com"}}) {
+		t.Error("a nil scope should include all requests")
+	}
+}
+
+func TestNewScopeInvalidRules(t *testing.T) {
+	tests := []ScopeRule{
+		{CIDRs: []string{"10.0.0.0/33"}},
+		{CIDRs: []string{"not an ip"}},
+		{Ports: []string{"https"}},
+		{Ports: []string{"8100-8000"}},
+		{Ports: []string{"8000-x"}},
+		{PathRegex: "("},
+		{URLRegex: "[a-"},
+	}
+
+	for _, rule := range tests {
+		if _, err := NewScope(&ScopeConfig{Include: []ScopeRule{rule}}); err == nil {
+			t.Errorf("NewScope(%+v) should fail", rule)
+		}
+		if _, err := NewScope(&ScopeConfig{Exclude: []ScopeRule{rule}}); err == nil {
+			t.Errorf("NewScope(exclude %+v) should fail", rule)
+		}
+	}
+}
+
+// 规范化扩展名时不修改调用者的规则
+func TestNewScopeKeepsRule(t *testing.T) {
+	extensions := []string{".PNG", " Css "}
+	config := &ScopeConfig{Include: []ScopeRule{{Extensions: extensions}}}
+	if _, err := NewScope(config); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(extensions, []string{".PNG", " Css "}) {
+		t.Fatalf("the extensions are modified: %q", extensions)
+	}
+}
+
+func TestScopeConfigFromFlags(t *testing.T) {
+	config := ScopeConfigFromFlags([]string{" Example.com ", "*.test.org", "10.0.0.1", "api.example.net:8443", "[::1]:8080", ""}, []string{"logout", "delete"})
+
+	want := &ScopeConfig{
+		Include: []ScopeRule{
+			{Hosts: []string{"example.com", "*.example.com"}},
+			{Hosts: []string{"*.test.org"}},
+			{CIDRs: []string{"10.0.0.1"}},
+			{Hosts: []string{"api.example.net", "*.api.example.net"}, Ports: []string{"8443"}},
+			{CIDRs: []string{"::1"}, Ports: []string{"8080"}},
+		},
+		Exclude: []ScopeRule{
+			{Keywords: []string{"logout", "delete"}},
+		},
+	}
+	if !reflect.DeepEqual(config, want) {
+		t.Fatalf("config = %+v, want %+v", config, want)
+	}
+
+	scope, err := NewScope(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		url string
+		in  bool
+	}{
+		{"http://example.com/", true},
+		{"https://www.EXAMPLE.com/a", true},
+		{"http://notexample.com/", false},
+		{"http://test.org/", true},
+		{"http://a.b.test.org/", true},
+		{"http://10.0.0.1:8080/", true},
+		{"http://10.0.0.2/", false},
+		{"https://api.example.net:8443/", true},
+		{"https://v2.api.example.net:8443/", true},
+		{"https://api.example.net/", false},
+		{"http://[::1]:8080/", true},
+		{"http://[::1]:8081/", false},
+		{"http://example.com/user/logout", false},
+		{"http://example.com/?action=delete", false},
+	}
+	for _, tt := range tests {
+		if in := scope.InScope(httptest.NewRequest("GET", tt.url, nil)); in != tt.in {
+			t.Errorf("%s: InScope = %v, want %v", tt.url, in, tt.in)
+		}
+	}
+
+	// 没有 --hosts 时全部包含, 只排除关键词
+	config = ScopeConfigFromFlags(nil, nil)
+	if len(config.Include) != 0 || len(config.Exclude) != 0 {
+		t.Fatalf("config = %+v", config)
+	}
+}
+
+func TestScopeConfigMerge(t *testing.T) {
+	config := ScopeConfigFromFlags([]string{"example.com"}, nil)
+	config.Merge(&ScopeConfig{
+		Include: []ScopeRule{{Hosts: []string{"other.com"}}},
+		Exclude: []ScopeRule{{Paths: []string{"/health"}}},
+	})
+	config.Merge(nil)
+
+	if len(config.Include) != 2 || len(config.Exclude) != 1 {
+		t.Fatalf("config = %+v", config)
+	}
+}
@@ -0,0 +1,126 @@
+package core
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"math"
+	"net"
+	"time"
+)
+
+// 上游服务器的证书信息, 每个host记录一次, 证书变化时重新记录
+type ServerCertResult struct {
+	Id                 string   `json:"id"`
+	Type               string   `json:"type"`       // 固定为 server_cert
+	Host               string   `json:"host"`       // 连接的地址
+	ServerName         string   `json:"serverName"` // 发送的SNI
+	TLSVersion         string   `json:"tlsVersion"`
+	CipherSuite        string   `json:"cipherSuite"`
+	ALPN               string   `json:"alpn,omitempty"` // 协商的协议
+	Subject            string   `json:"subject"`
+	Issuer             string   `json:"issuer"`
+	DNSNames           []string `json:"dnsNames,omitempty"`
+	IPAddresses        []string `json:"ipAddresses,omitempty"`
+	SerialNumber       string   `json:"serialNumber"`
+	NotBefore          string   `json:"notBefore"`
+	NotAfter           string   `json:"notAfter"`
+	ExpiresInDays      int      `json:"expiresInDays"` // 已过期时为负数
+	KeyType            string   `json:"keyType"`       // 例如 rsa2048、ecdsa-p256
+	SignatureAlgorithm string   `json:"signatureAlgorithm"`
+	SelfSigned         bool     `json:"selfSigned"`
+	Verified           bool     `json:"verified"` // 证书链是否验证通过
+	VerifyError        string   `json:"verifyError,omitempty"`
+	Chain              []string `json:"chain,omitempty"` // 服务器发送的其余证书的主题
+	FingerprintSHA256  string   `json:"fingerprintSha256"`
+	Time               string   `json:"time"`
+}
+
+func TLSVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+
+	return fmt.Sprintf("0x%04x", version)
+}
+
+func CipherSuiteName(id uint16) string {
+	for _, suites := range [][]*tls.CipherSuite{tls.CipherSuites(), tls.InsecureCipherSuites()} {
+		for _, suite := range suites {
+			if suite.ID == id {
+				return suite.Name
+			}
+		}
+	}
+
+	return fmt.Sprintf("0x%04x", id)
+}
+
+// 按roots验证服务器的证书链, roots为空时使用系统根证书
+func VerifyServerCertificate(state tls.ConnectionState, serverName string, roots *x509.CertPool) error {
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("the server did not send any certificate")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		DNSName:       serverName,
+	})
+
+	return err
+}
+
+// 由握手结果生成记录, verifyErr为证书链的验证结果
+func NewServerCertResult(host string, serverName string, state tls.ConnectionState, verifyErr error) *ServerCertResult {
+	now := time.Now()
+	result := &ServerCertResult{
+		Type:        "server_cert",
+		Host:        host,
+		ServerName:  serverName,
+		TLSVersion:  TLSVersionName(state.Version),
+		CipherSuite: CipherSuiteName(state.CipherSuite),
+		ALPN:        state.NegotiatedProtocol,
+		Verified:    verifyErr == nil,
+		Time:        now.Format("2006-01-02 15:04:05"),
+	}
+	if verifyErr != nil {
+		result.VerifyError = verifyErr.Error()
+	}
+	if len(state.PeerCertificates) == 0 {
+		return result
+	}
+
+	cert := state.PeerCertificates[0]
+	result.Subject = cert.Subject.String()
+	result.Issuer = cert.Issuer.String()
+	result.DNSNames = append(result.DNSNames, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		result.IPAddresses = append(result.IPAddresses, net.IP(ip).String())
+	}
+	result.SerialNumber = fmt.Sprintf("%X", cert.SerialNumber)
+	result.NotBefore = cert.NotBefore.Format(time.RFC3339)
+	result.NotAfter = cert.NotAfter.Format(time.RFC3339)
+	result.ExpiresInDays = int(math.Floor(cert.NotAfter.Sub(now).Hours() / 24))
+	result.KeyType = PublicKeyType(cert.PublicKey)
+	result.SignatureAlgorithm = cert.SignatureAlgorithm.String()
+	result.SelfSigned = isSelfSigned(cert)
+	for _, c := range state.PeerCertificates[1:] {
+		result.Chain = append(result.Chain, c.Subject.String())
+	}
+	result.FingerprintSHA256 = FingerprintSHA256(cert)
+
+	return result
+}
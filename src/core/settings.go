@@ -1,18 +1,56 @@
 package core
 
 type Settings struct {
-	Id               string            // 标记ID
-	IP               string            // IP
-	Port             uint16            // 端口号
-	RemoteOutputAddr string            // 远程地址,保存数据
-	Hosts            []string          // 指定要过滤的host
-	MaxRunTime       int               // 最大执行执行时间(分钟)
-	Headers          map[string]string // 过滤的请求添加头
-	IgnoreWords      []string          // 忽略包含有某些关键词的url，不作为结果输出
-	IsContainHttps   bool              // 是否包含TLS通讯数据
-	MessageAddr      string            // 消息地址
-	Ca               string            // 保存PEM证书路径
-	PriKey           string            // PriKey路径
+	Id                 string               // 标记ID
+	IP                 string               // IP
+	Port               uint16               // 端口号
+	RemoteOutputAddr   string               // 远程地址,保存数据
+	Hosts              []string             // 指定要过滤的host
+	MaxRunTime         int                  // 最大执行执行时间(分钟)
+	Headers            map[string]string    // 过滤的请求添加头
+	IgnoreWords        []string             // 忽略包含有某些关键词的url，不作为结果输出
+	IsContainHttps     bool                 // 是否包含TLS通讯数据
+	MessageAddr        string               // 消息地址
+	Ca                 string               // 保存PEM证书路径
+	PriKey             string               // PriKey路径
+	MagicHost          string               // 内置页面的域名
+	PassthroughHosts   []string             // 不解密的host
+	AutoPassthrough    int                  // 连续握手失败多少次后不再解密
+	CAChain            string               // 中间证书文件路径
+	CAPassword         string               // PKCS#12或者加密私钥的密码
+	HeaderRules        []HeaderRule         // 请求头改写规则
+	IsCaptureBody      bool                 // 是否在结果中保存响应体
+	MaxBodySize        int                  // 保存响应体的最大长度(字节)
+	Methods            []string             // 允许记录的请求方法, 为空表示全部
+	BatchSize          int                  // 每次发送到远程地址的结果数
+	FlushInterval      int                  // 不足一批结果时的发送间隔(秒)
+	MaxRetries         int                  // 发送失败的重试次数
+	QueueSize          int                  // 发送队列长度
+	SpoolDir           string               // 远程地址不可用时保存结果的目录
+	HarPath            string               // HAR文件的保存路径, 为空表示不记录
+	HarMaxEntries      int                  // HAR最多保存的记录数
+	HarMaxSize         int                  // HAR最多占用的内存(MB)
+	Scope              *ScopeConfig         // 范围规则
+	IsKeepStatic       bool                 // 是否保留静态资源
+	StaticExtensions   []string             // 自定义的静态资源扩展名
+	StaticContentTypes []string             // 自定义的静态资源Content-Type
+	CAOptions          *CAOptions           // 生成CA的选项
+	LeafValidity       int                  // 叶子证书有效期(天)
+	LeafKeyType        string               // 叶子证书私钥类型
+	CertCacheSize      int                  // 内存中缓存的叶子证书数
+	CertCacheDir       string               // 叶子证书的磁盘缓存目录, 为空表示不保存
+	LeafMimic          bool                 // 按上游服务器的证书仿造叶子证书
+	SocksPort          uint16               // SOCKS5的端口, 0表示不开启
+	SocksUser          string               // SOCKS5的用户名
+	SocksPassword      string               // SOCKS5的密码
+	TransparentPort    uint16               // 透明代理的端口, 0表示不开启
+	ReverseUpstream    string               // 反向代理的上游地址
+	ReversePort        uint16               // 反向代理的端口
+	ReverseHTTPS       bool                 // 反向代理是否使用https
+	UpstreamTLS        []UpstreamTLSProfile // 连接上游服务器的TLS配置
+	UpstreamInsecure   bool                 // 不验证没有匹配任何配置的上游服务器证书
+	UpstreamProxyRules []UpstreamProxyRule  // 上游代理规则
+	DisableHTTP2       bool                 // 解密的连接不协商h2
 }
 
 func NewSettings() *Settings {
@@ -20,5 +58,10 @@ func NewSettings() *Settings {
 		Headers:     make(map[string]string),
 		IgnoreWords: []string{},
 		Hosts:       []string{},
+		HeaderRules: []HeaderRule{},
+		Methods:     []string{},
+		MaxRetries:  5,
+		Scope:       NewScopeConfig(),
+		CAOptions:   NewCAOptions(),
 	}
 }
@@ -2,6 +2,7 @@ package core
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"io"
@@ -12,22 +13,97 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"unicode/utf8"
 )
 
 //easyjson:json
 type RequestResult struct {
 	Id       string            `json:"id"`
+	Protocol string            `json:"protocol"` // 客户端请求的协议, HTTP/1.1 或 HTTP/2.0
 	Method   string            `json:"method"`
 	Link     string            `json:"link"`
 	Headers  map[string]string `json:"headers"`
 	PostData string            `json:"postData"`
-	Tag      int               `json:"tag"`  // 标记链接是否
-	Hash     string            `json:"hash"` // 结构集的唯一标记
+	Tag      int               `json:"tag"`                // 标记链接是否
+	Hash     string            `json:"hash"`               // 结构集的唯一标记
+	FlowId   string            `json:"flowId"`             // 请求和响应的关联ID
+	Response *ResponseResult   `json:"response,omitempty"` // 响应信息
+	TLS      *ClientTLSInfo    `json:"tls,omitempty"`      // 客户端的TLS信息, 只有解密的https请求才有
+}
+
+// 客户端ClientHello中的信息和指纹, 用于区分发出请求的客户端
+type ClientTLSInfo struct {
+	SNI     string   `json:"sni"`
+	ALPN    []string `json:"alpn,omitempty"` // 客户端提供的ALPN
+	JA3     string   `json:"ja3"`
+	JA3Hash string   `json:"ja3Hash"`
+	JA4     string   `json:"ja4"`
+}
+
+type ResponseResult struct {
+	Protocol      string            `json:"protocol"` // 上游服务器响应的协议
+	StatusCode    int               `json:"statusCode"`
+	Headers       map[string]string `json:"headers"`
+	ContentType   string            `json:"contentType"`
+	BodyLength    int64             `json:"bodyLength"`             // 响应体的实际长度
+	BodyHash      string            `json:"bodyHash"`               // 响应体的sha256
+	Body          string            `json:"body,omitempty"`         // 截断后的响应体, 需要开启 --capture-body
+	BodyEncoding  string            `json:"bodyEncoding,omitempty"` // 二进制内容为base64
+	BodyTruncated bool              `json:"bodyTruncated,omitempty"`
+}
+
+func NewResponseResult(res *http.Response) *ResponseResult {
+	result := &ResponseResult{
+		Protocol:   res.Proto,
+		StatusCode: res.StatusCode,
+		Headers:    make(map[string]string),
+	}
+
+	for k, _ := range res.Header {
+		result.Headers[k] = res.Header.Get(k)
+	}
+
+	if v := res.Header.Get("Content-Type"); len(v) > 0 {
+		mediaType, _, err := mime.ParseMediaType(v)
+		if err != nil {
+			result.ContentType = v
+		} else {
+			result.ContentType = mediaType
+		}
+	}
+
+	return result
+}
+
+// 保存截断后的响应体, 压缩过的完整响应体会先解压
+func (p *ResponseResult) SetBody(body []byte, truncated bool, maxSize int) {
+	p.BodyTruncated = truncated
+
+	if !truncated {
+		if decoded, err := common.DecodeContent(body, p.Headers["Content-Encoding"], maxSize); err == nil {
+			body = decoded
+			if len(body) > maxSize {
+				body = body[:maxSize]
+				p.BodyTruncated = true
+			}
+		}
+	}
+
+	if utf8.Valid(body) {
+		p.Body = string(body)
+		p.BodyEncoding = ""
+	} else {
+		p.Body = base64.StdEncoding.EncodeToString(body)
+		p.BodyEncoding = "base64"
+	}
 }
 
 type RemoteOutputCrawlResult struct {
-	Id     string          `json:"id"`
-	Result []RequestResult `json:"result"`
+	Id          string              `json:"id"`
+	Result      []RequestResult     `json:"result"`
+	Hosts       []ServerCertResult  `json:"hosts,omitempty"`       // 上游服务器的证书信息
+	Messages    []WebSocketMessage  `json:"messages,omitempty"`    // WebSocket消息
+	Passthrough []PassthroughResult `json:"passthrough,omitempty"` // 不解密的连接
 }
 
 func NewRemoteOutputCrawlResult() *RemoteOutputCrawlResult {
@@ -36,59 +112,89 @@ func NewRemoteOutputCrawlResult() *RemoteOutputCrawlResult {
 	}
 }
 
+// 没有解密的TLS连接, 只记录元数据
+type PassthroughResult struct {
+	Id            string   `json:"id"`
+	Type          string   `json:"type"`           // 固定为 passthrough
+	Host          string   `json:"host"`           // CONNECT的目标地址
+	SNI           string   `json:"sni"`            // ClientHello中的SNI
+	ALPN          []string `json:"alpn,omitempty"` // 客户端提供的ALPN
+	JA3Hash       string   `json:"ja3Hash,omitempty"`
+	JA4           string   `json:"ja4,omitempty"`
+	Reason        string   `json:"reason"` // rule: 匹配规则, auto: 多次握手失败, invalid_client_hello: 无法解析ClientHello
+	ClientAddr    string   `json:"clientAddr"`
+	BytesSent     int64    `json:"bytesSent"`     // 客户端发送的字节数
+	BytesReceived int64    `json:"bytesReceived"` // 服务端发送的字节数
+	StartTime     string   `json:"startTime"`
+	Duration      int64    `json:"duration"` // 毫秒
+	Error         string   `json:"error,omitempty"`
+}
+
+// 可能带有请求体的方法
+var bodyMethods = map[string]struct{}{
+	"POST":   struct{}{},
+	"PUT":    struct{}{},
+	"PATCH":  struct{}{},
+	"DELETE": struct{}{},
+}
+
+// 请求体的最大长度
+const maxPostDataSize = 1024 * 1024
+
 func ToRequestResult(Id string, req *http.Request) (*RequestResult, error) {
 	if req == nil {
 		return nil, errors.New("request is empty")
 	}
 
-	if req.Method == "GET" || req.Method == "POST" {
-		crawlResult := &RequestResult{
-			Id:      Id,
-			Method:  req.Method,
-			Link:    req.URL.String(),
-			Headers: make(map[string]string),
-			Tag:     1,
-		}
+	// CONNECT只是建立隧道, 不作为结果
+	if req.Method == "CONNECT" {
+		return nil, nil
+	}
 
-		for k, _ := range req.Header {
-			crawlResult.Headers[k] = req.Header.Get(k)
-		}
+	crawlResult := &RequestResult{
+		Id:       Id,
+		Protocol: req.Proto,
+		Method:   req.Method,
+		Link:     req.URL.String(),
+		Headers:  make(map[string]string),
+		Tag:      1,
+	}
 
-		if req.Method == "POST" {
-			// 数据长度不能超过1M
-			if req.ContentLength > 0 && req.ContentLength <= 1024*1024 {
-				body, err := ioutil.ReadAll(req.Body)
-				if err != nil {
-					return crawlResult, nil
-				}
+	for k, _ := range req.Header {
+		crawlResult.Headers[k] = req.Header.Get(k)
+	}
 
-				req.Body.Close()
-				req.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+	if req.Body == nil || req.Body == http.NoBody || req.ContentLength == 0 {
+		return crawlResult, nil
+	}
+	// 其他方法只有明确带有请求体时才读取
+	if _, ok := bodyMethods[req.Method]; !ok && req.ContentLength < 0 {
+		return crawlResult, nil
+	}
+	// 数据长度不能超过1M
+	if req.ContentLength > maxPostDataSize {
+		return crawlResult, nil
+	}
 
-				if v, ok := crawlResult.Headers["Content-Type"]; ok {
-					mediaType, _, err := mime.ParseMediaType(v)
-					if err != nil {
-						crawlResult.PostData = string(body)
-						goto exit
-					}
-					if mediaType == "application/x-www-form-urlencoded" ||
-						mediaType == "text/plain" {
-						crawlResult.PostData = string(body)
-					} else if strings.HasPrefix(mediaType, "multipart/") {
-						crawlResult.PostData = string(body)
-					} else {
-						crawlResult.PostData = string(body)
-						goto exit
-					}
-				}
-			}
-		}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxPostDataSize+1))
+	if err != nil {
+		return crawlResult, nil
+	}
 
-	exit:
+	// 长度未知(chunked)且超过1M时, 原样还原请求体, 不记录
+	if len(body) > maxPostDataSize {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
 		return crawlResult, nil
 	}
 
-	return nil, nil
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+	crawlResult.PostData = string(body)
+
+	return crawlResult, nil
 }
 
 func (p *RequestResult) IslikeVuejsorAngularLnk() bool {
@@ -137,7 +243,7 @@ func (p *RequestResult) GetUrlWithoutFragmentEx(ignorecase bool) string {
 		if len(path) == 0 {
 			path = "/"
 		}
-		u_url = uri.Scheme + "://" + uri.Host + path
+		u_url = strings.ToLower(uri.Scheme) + "://" + strings.ToLower(uri.Host) + path
 	} else {
 		// 分析原始查询
 		var arguments string
@@ -166,16 +272,19 @@ func (p *RequestResult) GetUrlWithoutFragmentEx(ignorecase bool) string {
 
 			if mediaType == "application/x-www-form-urlencoded" {
 				content_type = "application/x-www-form-urlencoded"
-			} else if mediaType == "application/hal+json" ||
-				mediaType == "application/json" {
+			} else if mediaType == "application/json" ||
+				mediaType == "text/json" ||
+				strings.HasSuffix(mediaType, "+json") {
+				// application/hal+json, application/merge-patch+json, application/json-patch+json 等
 				content_type = "json"
 			} else if strings.HasPrefix(mediaType, "multipart/") {
 				content_type = "multipart/form-data"
 
 				mr := multipart.NewReader(strings.NewReader(p.PostData), params["boundary"])
 				for {
+					// 结束或者请求体格式错误
 					ptmp, err1 := mr.NextRawPart()
-					if err1 == io.EOF {
+					if err1 != nil {
 						break
 					}
 
@@ -189,7 +298,7 @@ func (p *RequestResult) GetUrlWithoutFragmentEx(ignorecase bool) string {
 			} else if mediaType == "text/xml" ||
 				mediaType == "application/xml" ||
 				mediaType == "application/xhtml+xml" ||
-				mediaType == "application/atom+xml" {
+				strings.HasSuffix(mediaType, "+xml") {
 				content_type = "xml"
 			}
 		}
@@ -199,11 +308,22 @@ func (p *RequestResult) GetUrlWithoutFragmentEx(ignorecase bool) string {
 		case "xml":
 			u_url += common.CalcXMLFeatureStr(p.PostData)
 		case "json":
-			m := map[string]interface{}{}
+			var m interface{}
 			//Parsing/Unmarshalling JSON encoding/json
 			err := json.Unmarshal([]byte(p.PostData), &m)
 			if err == nil {
-				u_url += common.CalcJSONFeatureStr(m)
+				switch v := m.(type) {
+				case map[string]interface{}:
+					u_url += common.CalcJSONFeatureStr(v)
+				case []interface{}:
+					// PATCH等请求常见顶层为数组, 以第一个元素的结构作为特征
+					u_url += "[]"
+					if len(v) > 0 {
+						if first, ok := v[0].(map[string]interface{}); ok {
+							u_url += common.CalcJSONFeatureStr(first)
+						}
+					}
+				}
 			}
 		case "application/x-www-form-urlencoded":
 			postArguments := strings.Split(p.PostData, "&")
@@ -0,0 +1,184 @@
+package core
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"mitmgo/src/core/common"
+	"strconv"
+	"strings"
+)
+
+// 连接上游服务器时的TLS配置, 按host匹配, 使用第一个匹配的配置
+type UpstreamTLSProfile struct {
+	Hosts          []string `json:"hosts"`          // host通配符, 为空表示全部
+	SkipVerify     bool     `json:"skipVerify"`     // 不验证服务器证书
+	RootCAs        []string `json:"rootCAs"`        // 额外信任的根证书文件, PEM或DER
+	ClientCert     string   `json:"clientCert"`     // 客户端证书, PEM或PKCS#12
+	ClientKey      string   `json:"clientKey"`      // 客户端私钥, 证书文件中包含私钥时可以为空
+	ClientPassword string   `json:"clientPassword"` // PKCS#12或者加密私钥的密码
+	MinVersion     string   `json:"minVersion"`     // 1.0, 1.1, 1.2, 1.3, 可以带有TLS或TLSv前缀
+	MaxVersion     string   `json:"maxVersion"`
+	Ciphers        []string `json:"ciphers"` // 套件名称, 例如 TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, 只影响TLS 1.2及以下
+	ALPN           []string `json:"alpn"`
+}
+
+type upstreamTLSMatcher struct {
+	hosts  []string
+	config *tls.Config
+}
+
+type UpstreamTLS struct {
+	matchers []*upstreamTLSMatcher
+	fallback *tls.Config
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	// 兼容 tls1.2 和openssl的 TLSv1.2
+	version = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(version)), "tls")
+	version = strings.TrimPrefix(version, "v")
+	if len(version) == 0 {
+		return 0, nil
+	}
+
+	v, ok := tlsVersions[version]
+	if !ok {
+		return 0, fmt.Errorf("unsupported tls version: %s", version)
+	}
+
+	return v, nil
+}
+
+// 按名称或者十六进制(0xc02f)查找套件
+func parseCipherSuite(name string) (uint16, error) {
+	name = strings.TrimSpace(name)
+	if strings.HasPrefix(strings.ToLower(name), "0x") {
+		v, err := strconv.ParseUint(name[2:], 16, 16)
+		if err != nil {
+			return 0, fmt.Errorf("invalid cipher suite: %s", name)
+		}
+		return uint16(v), nil
+	}
+
+	for _, suites := range [][]*tls.CipherSuite{tls.CipherSuites(), tls.InsecureCipherSuites()} {
+		for _, suite := range suites {
+			if strings.EqualFold(suite.Name, name) {
+				return suite.ID, nil
+			}
+		}
+	}
+
+	return 0, fmt.Errorf("unsupported cipher suite: %s", name)
+}
+
+func (p *UpstreamTLSProfile) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: p.SkipVerify,
+	}
+
+	if len(p.RootCAs) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		for _, path := range p.RootCAs {
+			certs, err := LoadCertificates(path, "")
+			if err != nil {
+				return nil, err
+			}
+			for _, cert := range certs {
+				pool.AddCert(cert)
+			}
+		}
+		config.RootCAs = pool
+	}
+
+	if len(p.ClientCert) > 0 {
+		cert, err := LoadKeyPair(p.ClientCert, p.ClientKey, p.ClientPassword)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	var err error
+	config.MinVersion, err = parseTLSVersion(p.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	config.MaxVersion, err = parseTLSVersion(p.MaxVersion)
+	if err != nil {
+		return nil, err
+	}
+	if config.MinVersion > 0 && config.MaxVersion > 0 && config.MinVersion > config.MaxVersion {
+		return nil, errors.New("the min tls version is greater than the max version")
+	}
+
+	for _, name := range p.Ciphers {
+		id, err := parseCipherSuite(name)
+		if err != nil {
+			return nil, err
+		}
+		config.CipherSuites = append(config.CipherSuites, id)
+	}
+
+	config.NextProtos = append(config.NextProtos, p.ALPN...)
+
+	return config, nil
+}
+
+// fallback为没有匹配任何配置时使用的配置, 为空时验证服务器证书
+func NewUpstreamTLS(profiles []UpstreamTLSProfile, fallback *tls.Config) (*UpstreamTLS, error) {
+	if fallback == nil {
+		fallback = &tls.Config{}
+	}
+	upstream := &UpstreamTLS{
+		fallback: fallback,
+	}
+
+	for i, profile := range profiles {
+		config, err := profile.tlsConfig()
+		if err != nil {
+			return nil, fmt.Errorf("upstream tls profile %d: %v", i, err)
+		}
+
+		hosts := make([]string, 0, len(profile.Hosts))
+		for _, host := range profile.Hosts {
+			hosts = append(hosts, strings.ToLower(strings.TrimSpace(host)))
+		}
+		upstream.matchers = append(upstream.matchers, &upstreamTLSMatcher{
+			hosts:  hosts,
+			config: config,
+		})
+	}
+
+	return upstream, nil
+}
+
+// 获取连接host时使用的配置, 返回的是副本, 已经设置了ServerName
+func (p *UpstreamTLS) ConfigFor(host string) *tls.Config {
+	hostname := strings.ToLower(common.StripPort(host))
+
+	config := p.fallback
+	for _, matcher := range p.matchers {
+		if len(matcher.hosts) == 0 || common.MatchHostAny(matcher.hosts, hostname) {
+			config = matcher.config
+			break
+		}
+	}
+
+	config = config.Clone()
+	if len(config.ServerName) == 0 {
+		config.ServerName = hostname
+	}
+
+	return config
+}
@@ -0,0 +1,200 @@
+package core
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseTLSVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		result  uint16
+		err     bool
+	}{
+		{"", 0, false},
+		{" ", 0, false},
+		{"1.0", tls.VersionTLS10, false},
+		{"1.1", tls.VersionTLS11, false},
+		{"1.2", tls.VersionTLS12, false},
+		{" 1.3 ", tls.VersionTLS13, false},
+		{"TLS1.2", tls.VersionTLS12, false},
+		{"tls1.3", tls.VersionTLS13, false},
+		{"TLSv1.2", tls.VersionTLS12, false},
+		{"1.4", 0, true},
+		{"ssl3", 0, true},
+		{"12", 0, true},
+	}
+
+	for _, tt := range tests {
+		result, err := parseTLSVersion(tt.version)
+		if (err != nil) != tt.err || result != tt.result {
+			t.Errorf("parseTLSVersion(%q) = %#x, %v, want %#x", tt.version, result, err, tt.result)
+		}
+	}
+}
+
+func TestParseCipherSuite(t *testing.T) {
+	tests := []struct {
+		name   string
+		result uint16
+		err    bool
+	}{
+		{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, false},
+		{" tls_ecdhe_ecdsa_with_chacha20_poly1305_sha256 ", tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256, false},
+		{"TLS_RSA_WITH_AES_128_CBC_SHA", tls.TLS_RSA_WITH_AES_128_CBC_SHA, false},
+		{"TLS_RSA_WITH_RC4_128_SHA", tls.TLS_RSA_WITH_RC4_128_SHA, false},
+		{"0xc02f", tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, false},
+		{"0XC02F", tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, false},
+		{"0x1301", tls.TLS_AES_128_GCM_SHA256, false},
+		{"0xfafa", 0xfafa, false},
+		{"0x", 0, true},
+		{"0xzz", 0, true},
+		{"0x10000", 0, true},
+		{"ECDHE-RSA-AES128-GCM-SHA256", 0, true},
+		{"", 0, true},
+	}
+
+	for _, tt := range tests {
+		result, err := parseCipherSuite(tt.name)
+		if (err != nil) != tt.err || result != tt.result {
+			t.Errorf("parseCipherSuite(%q) = %#x, %v, want %#x", tt.name, result, err, tt.result)
+		}
+	}
+}
+
+func TestUpstreamTLSConfigFor(t *testing.T) {
+	upstream, err := NewUpstreamTLS([]UpstreamTLSProfile{
+		{
+			Hosts:      []string{"*.Internal.example.com"},
+			SkipVerify: true,
+			MinVersion: "1.2",
+			MaxVersion: "TLSv1.3",
+			Ciphers:    []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "0xc030"},
+			ALPN:       []string{"h2", "http/1.1"},
+		},
+		{
+			Hosts:      []string{" api.internal.example.com ", "10.0.0.1"},
+			MaxVersion: "1.1",
+		},
+		{
+			Hosts:      []string{"legacy.example.com"},
+			MinVersion: "1.0",
+		},
+	}, &tls.Config{MinVersion: tls.VersionTLS12})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host       string
+		serverName string
+		skipVerify bool
+		minVersion uint16
+		maxVersion uint16
+		ciphers    []uint16
+		alpn       []string
+	}{
+		// 使用第一个匹配的配置
+		{"www.internal.example.com:443", "www.internal.example.com", true, tls.VersionTLS12, tls.VersionTLS13, []uint16{0xc02f, 0xc030}, []string{"h2", "http/1.1"}},
+		{"API.internal.example.com", "api.internal.example.com", true, tls.VersionTLS12, tls.VersionTLS13, []uint16{0xc02f, 0xc030}, []string{"h2", "http/1.1"}},
+		{"internal.example.com", "internal.example.com", true, tls.VersionTLS12, tls.VersionTLS13, []uint16{0xc02f, 0xc030}, []string{"h2", "http/1.1"}},
+		{"10.0.0.1:8443", "10.0.0.1", false, 0, tls.VersionTLS11, nil, nil},
+		{"LEGACY.example.com:8443", "legacy.example.com", false, tls.VersionTLS10, 0, nil, nil},
+		// 没有匹配的配置时使用fallback
+		{"www.example.com", "www.example.com", false, tls.VersionTLS12, 0, nil, nil},
+		{"sub.legacy.example.com", "sub.legacy.example.com", false, tls.VersionTLS12, 0, nil, nil},
+		{"[2001:db8::1]:443", "2001:db8::1", false, tls.VersionTLS12, 0, nil, nil},
+	}
+
+	for _, tt := range tests {
+		config := upstream.ConfigFor(tt.host)
+		if config.ServerName != tt.serverName || config.InsecureSkipVerify != tt.skipVerify ||
+			config.MinVersion != tt.minVersion || config.MaxVersion != tt.maxVersion {
+			t.Errorf("ConfigFor(%q) = {%s %v %#x %#x}, want {%s %v %#x %#x}", tt.host,
+				config.ServerName, config.InsecureSkipVerify, config.MinVersion, config.MaxVersion,
+				tt.serverName, tt.skipVerify, tt.minVersion, tt.maxVersion)
+		}
+		if !reflect.DeepEqual(config.CipherSuites, tt.ciphers) || !reflect.DeepEqual(config.NextProtos, tt.alpn) {
+			t.Errorf("ConfigFor(%q): ciphers = %#x, alpn = %v, want %#x, %v", tt.host, config.CipherSuites, config.NextProtos, tt.ciphers, tt.alpn)
+		}
+	}
+
+	// 返回的是副本
+	config := upstream.ConfigFor("www.internal.example.com")
+	config.ServerName = "changed"
+	config.InsecureSkipVerify = false
+	if config := upstream.ConfigFor("www.internal.example.com"); config.ServerName != "www.internal.example.com" || !config.InsecureSkipVerify {
+		t.Fatal("ConfigFor returned the shared config")
+	}
+
+	// 匹配全部的配置之后的配置不会使用
+	upstream, err = NewUpstreamTLS([]UpstreamTLSProfile{{SkipVerify: true}, {Hosts: []string{"www.example.com"}, MinVersion: "1.3"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config := upstream.ConfigFor("www.example.com"); !config.InsecureSkipVerify || config.MinVersion != 0 {
+		t.Fatalf("config = %+v", config)
+	}
+
+	// fallback中指定的ServerName不会被覆盖
+	upstream, err = NewUpstreamTLS(nil, &tls.Config{ServerName: "fixed.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config := upstream.ConfigFor("www.example.com"); config.ServerName != "fixed.example.com" {
+		t.Fatalf("server name = %s", config.ServerName)
+	}
+}
+
+func TestUpstreamTLSFiles(t *testing.T) {
+	material := newTestCA(t)
+	dir := t.TempDir()
+	caPath := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caPath, pemOf("CERTIFICATE", material.Cert.Raw), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(dir, "ca.key")
+	if err := os.WriteFile(keyPath, pemOf("PRIVATE KEY", keyDER(t, material)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	upstream, err := NewUpstreamTLS([]UpstreamTLSProfile{{RootCAs: []string{caPath}, ClientCert: caPath, ClientKey: keyPath}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := upstream.ConfigFor("www.example.com")
+	if len(config.Certificates) != 1 {
+		t.Fatalf("%d client certificates, want 1", len(config.Certificates))
+	}
+
+	// 额外信任的根证书签发的证书可以验证通过
+	leaf, err := newTestIssuer(t, material).Issue("www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := leaf.Leaf.Verify(x509.VerifyOptions{DNSName: "www.example.com", Roots: config.RootCAs}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewUpstreamTLSInvalid(t *testing.T) {
+	tests := []UpstreamTLSProfile{
+		{MinVersion: "1.4"},
+		{MaxVersion: "ssl3"},
+		{MinVersion: "1.3", MaxVersion: "1.2"},
+		{Ciphers: []string{"TLS_UNKNOWN"}},
+		{Ciphers: []string{"0xzz"}},
+		{RootCAs: []string{filepath.Join(t.TempDir(), "missing.pem")}},
+		{ClientCert: filepath.Join(t.TempDir(), "missing.p12")},
+	}
+
+	for _, profile := range tests {
+		if _, err := NewUpstreamTLS([]UpstreamTLSProfile{{}, profile}, nil); err == nil {
+			t.Errorf("NewUpstreamTLS(%+v) should fail", profile)
+		}
+	}
+}
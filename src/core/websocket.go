@@ -0,0 +1,89 @@
+package core
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"mitmgo/src/core/common"
+	"strconv"
+	"unicode/utf8"
+)
+
+// WebSocket的操作码, https://tools.ietf.org/html/rfc6455#section-5.2
+const (
+	WebSocketOpContinuation = 0x0
+	WebSocketOpText         = 0x1
+	WebSocketOpBinary       = 0x2
+	WebSocketOpClose        = 0x8
+	WebSocketOpPing         = 0x9
+	WebSocketOpPong         = 0xa
+)
+
+// 消息的方向
+const (
+	WebSocketDirectionSend    = "send"    // 客户端发送给服务端
+	WebSocketDirectionReceive = "receive" // 服务端发送给客户端
+)
+
+// WebSocket连接中的一条消息, 通过FlowId与握手请求关联
+type WebSocketMessage struct {
+	Id              string `json:"id"`
+	Type            string `json:"type"` // 固定为 websocket_message
+	FlowId          string `json:"flowId"`
+	Link            string `json:"link"`      // 握手请求的地址
+	Direction       string `json:"direction"` // send 或 receive
+	Opcode          int    `json:"opcode"`
+	Payload         string `json:"payload"`
+	PayloadEncoding string `json:"payloadEncoding,omitempty"` // 二进制内容为base64
+	Length          int64  `json:"length"`                    // 消息的实际长度
+	Truncated       bool   `json:"truncated,omitempty"`
+	Hash            string `json:"hash"`      // 消息结构的唯一标记
+	Timestamp       int64  `json:"timestamp"` // 毫秒
+}
+
+func NewWebSocketMessage(flowId string, link string, direction string, opcode int, payload []byte, length int64, truncated bool) *WebSocketMessage {
+	message := &WebSocketMessage{
+		Type:      "websocket_message",
+		FlowId:    flowId,
+		Link:      link,
+		Direction: direction,
+		Opcode:    opcode,
+		Length:    length,
+		Truncated: truncated,
+	}
+
+	if opcode != WebSocketOpBinary && utf8.Valid(payload) {
+		message.Payload = string(payload)
+	} else {
+		message.Payload = base64.StdEncoding.EncodeToString(payload)
+		message.PayloadEncoding = "base64"
+	}
+
+	message.Hash, _ = common.ToMD5Str(link + direction + strconv.Itoa(opcode) + WebSocketMessageFeature(opcode, payload))
+
+	return message
+}
+
+// 消息的结构特征, JSON按键计算, 其他内容以内容本身作为特征
+func WebSocketMessageFeature(opcode int, payload []byte) string {
+	if opcode == WebSocketOpText {
+		var m interface{}
+		if err := json.Unmarshal(payload, &m); err == nil {
+			switch v := m.(type) {
+			case map[string]interface{}:
+				return "{}" + common.CalcJSONFeatureStr(v)
+			case []interface{}:
+				// 以第一个元素的结构作为特征
+				feature := "[]"
+				if len(v) > 0 {
+					if first, ok := v[0].(map[string]interface{}); ok {
+						feature += common.CalcJSONFeatureStr(first)
+					}
+				}
+				return feature
+			}
+		}
+	}
+
+	feature, _ := common.ToMD5Str(string(payload))
+	return feature
+}
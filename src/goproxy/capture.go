@@ -0,0 +1,89 @@
+package goproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"mitmgo/src/core"
+	"sync"
+	"time"
+)
+
+// 一次请求的采集状态, 保存在martian上下文中
+type flow struct {
+	result     *core.RequestResult // 需要输出的结果, 重复的请求为nil
+	harRequest *core.HarRequest    // 开启HAR时记录的请求
+	startTime  time.Time           // 开始转发请求的时间
+	headerTime time.Time           // 收到响应头的时间
+}
+
+// 包装响应体, 在转发给客户端的同时计算长度和hash, 并保存前limit个字节
+// 响应体读完或者关闭时调用done
+type captureBody struct {
+	rc        io.ReadCloser
+	hash      hash.Hash
+	buf       bytes.Buffer
+	limit     int
+	length    int64
+	truncated bool
+	once      sync.Once
+	done      func(body *captureBody)
+}
+
+func newCaptureBody(rc io.ReadCloser, limit int, done func(body *captureBody)) *captureBody {
+	return &captureBody{
+		rc:    rc,
+		hash:  sha256.New(),
+		limit: limit,
+		done:  done,
+	}
+}
+
+func (p *captureBody) Read(b []byte) (int, error) {
+	n, err := p.rc.Read(b)
+	if n > 0 {
+		p.hash.Write(b[:n])
+		p.length += int64(n)
+
+		if remain := p.limit - p.buf.Len(); remain > 0 {
+			if remain > n {
+				remain = n
+			}
+			p.buf.Write(b[:remain])
+		}
+		if p.length > int64(p.limit) {
+			p.truncated = true
+		}
+	}
+
+	if err == io.EOF {
+		p.finish()
+	}
+
+	return n, err
+}
+
+func (p *captureBody) Close() error {
+	err := p.rc.Close()
+	p.finish()
+
+	return err
+}
+
+func (p *captureBody) finish() {
+	p.once.Do(func() {
+		if p.done != nil {
+			p.done(p)
+		}
+	})
+}
+
+func (p *captureBody) Sum() string {
+	return hex.EncodeToString(p.hash.Sum(nil))
+}
+
+func (p *captureBody) Bytes() []byte {
+	return p.buf.Bytes()
+}
@@ -0,0 +1,309 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// 上游代理连接失败后, 在这段时间内优先使用其他代理
+const upstreamProxyCooldown = 30 * time.Second
+
+// 上游代理拒绝了请求, 代理本身可用, 不影响后续的连接
+type proxyRejectedError struct {
+	proxy  string
+	reason string
+}
+
+func (p *proxyRejectedError) Error() string {
+	return fmt.Sprintf("the upstream proxy %s rejected the connection: %s", p.proxy, p.reason)
+}
+
+// 按上游代理规则连接addr, 代理不可用时依次使用下一个
+func (p *ProxyEntity) dialUpstream(ctx context.Context, network string, addr string) (net.Conn, error) {
+	proxies := p.upstreamProxies.ProxiesFor(addr)
+	if len(proxies) == 0 {
+		return p.dialDirect(ctx, network, addr)
+	}
+
+	var lastErr error
+	for _, proxy := range p.orderProxies(proxies) {
+		conn, err := p.dialVia(ctx, proxy, network, addr)
+		if err == nil {
+			p.proxySucceeded(proxy)
+			return conn, nil
+		}
+		lastErr = err
+
+		if _, ok := err.(*proxyRejectedError); ok {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		p.proxyFailed(proxy, err)
+	}
+
+	return nil, lastErr
+}
+
+// 用于martian的连接, 包括没有解密的CONNECT
+func (p *ProxyEntity) dial(network string, addr string) (net.Conn, error) {
+	return p.dialUpstream(context.Background(), network, addr)
+}
+
+func (p *ProxyEntity) dialDirect(ctx context.Context, network string, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   p.Timeout,
+		KeepAlive: p.KeepAlive,
+	}
+
+	return dialer.DialContext(ctx, network, addr)
+}
+
+func proxyName(proxy *url.URL) string {
+	if proxy == nil {
+		return "direct"
+	}
+
+	return proxy.Redacted()
+}
+
+// 最近失败的代理排在后面, 全部失败时仍然按原来的顺序尝试
+func (p *ProxyEntity) orderProxies(proxies []*url.URL) []*url.URL {
+	p.lock_proxyFailures.Lock()
+	defer p.lock_proxyFailures.Unlock()
+
+	available := make([]*url.URL, 0, len(proxies))
+	down := make([]*url.URL, 0, len(proxies))
+	for _, proxy := range proxies {
+		if failedAt, ok := p.proxyFailures[proxyName(proxy)]; ok && time.Since(failedAt) < upstreamProxyCooldown {
+			down = append(down, proxy)
+			continue
+		}
+		available = append(available, proxy)
+	}
+
+	return append(available, down...)
+}
+
+func (p *ProxyEntity) proxyFailed(proxy *url.URL, err error) {
+	name := proxyName(proxy)
+	log.Printf("failed to connect the upstream proxy %s, error: %v", name, err)
+
+	p.lock_proxyFailures.Lock()
+	defer p.lock_proxyFailures.Unlock()
+
+	p.proxyFailures[name] = time.Now()
+}
+
+func (p *ProxyEntity) proxySucceeded(proxy *url.URL) {
+	p.lock_proxyFailures.Lock()
+	defer p.lock_proxyFailures.Unlock()
+
+	delete(p.proxyFailures, proxyName(proxy))
+}
+
+// 通过一个上游代理连接addr, proxy为nil时直接连接
+func (p *ProxyEntity) dialVia(ctx context.Context, proxy *url.URL, network string, addr string) (net.Conn, error) {
+	if proxy == nil {
+		return p.dialDirect(ctx, network, addr)
+	}
+
+	raw, err := p.dialDirect(ctx, "tcp", proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	// 握手的超时时间与连接相同
+	if p.Timeout > 0 {
+		raw.SetDeadline(time.Now().Add(p.Timeout))
+	}
+
+	// 握手成功后才替换conn, 失败时关闭raw
+	conn := raw
+	switch proxy.Scheme {
+	case "https":
+		config := p.upstreamTLS.ConfigFor(proxy.Host)
+		tlsConn := tls.Client(raw, config)
+		if err = tlsConn.Handshake(); err != nil {
+			break
+		}
+		conn = tlsConn
+		fallthrough
+	case "http":
+		var tunnel net.Conn
+		tunnel, err = httpConnect(conn, proxy, addr)
+		if err == nil {
+			conn = tunnel
+		}
+	case "socks5", "socks5h":
+		err = p.socksConnect(ctx, conn, proxy, addr)
+	default:
+		err = fmt.Errorf("unsupported upstream proxy: %s", proxy.Scheme)
+	}
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+// 通过HTTP CONNECT建立隧道
+func httpConnect(conn net.Conn, proxy *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credential := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credential)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, &proxyRejectedError{proxy: proxy.Redacted(), reason: res.Status}
+	}
+
+	// 代理可能已经发送了部分数据
+	if br.Buffered() > 0 {
+		buffered, _ := br.Peek(br.Buffered())
+		return &peekedConn{
+			Conn: conn,
+			r:    io.MultiReader(bytes.NewReader(append([]byte{}, buffered...)), conn),
+		}, nil
+	}
+
+	return conn, nil
+}
+
+// 通过SOCKS5建立连接, socks5在本地解析域名, socks5h由代理解析
+func (p *ProxyEntity) socksConnect(ctx context.Context, conn net.Conn, proxy *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+
+	method := byte(socksAuthNone)
+	if proxy.User != nil {
+		method = socksAuthPassword
+	}
+	if _, err := conn.Write([]byte{socksVersion, 1, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion || reply[1] != method {
+		return &proxyRejectedError{proxy: proxy.Redacted(), reason: "no acceptable authentication method"}
+	}
+
+	if method == socksAuthPassword {
+		user := proxy.User.Username()
+		password, _ := proxy.User.Password()
+		if len(user) > 255 || len(password) > 255 {
+			return errors.New("the username or the password of the socks5 proxy is too long")
+		}
+		auth := []byte{socksPasswordVersion, byte(len(user))}
+		auth = append(auth, user...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return &proxyRejectedError{proxy: proxy.Redacted(), reason: errSocksAuthFailed.Error()}
+		}
+	}
+
+	request := []byte{socksVersion, socksCmdConnect, 0}
+	ip := net.ParseIP(host)
+	if ip == nil && proxy.Scheme == "socks5" {
+		addrs, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+		if err != nil {
+			return err
+		}
+		if len(addrs) == 0 {
+			return fmt.Errorf("no such host: %s", host)
+		}
+		ip = addrs[0]
+	}
+	switch {
+	case ip == nil:
+		if len(host) > 255 {
+			return errors.New("the host is too long")
+		}
+		request = append(request, socksAtypDomain, byte(len(host)))
+		request = append(request, host...)
+	case ip.To4() != nil:
+		request = append(request, socksAtypIPv4)
+		request = append(request, ip.To4()...)
+	default:
+		request = append(request, socksAtypIPv6)
+		request = append(request, ip.To16()...)
+	}
+	request = append(request, byte(port>>8), byte(port))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	// 回复: VER REP RSV ATYP BND.ADDR BND.PORT
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != socksRepSucceeded {
+		return &proxyRejectedError{proxy: proxy.Redacted(), reason: fmt.Sprintf("socks5 reply %d", header[1])}
+	}
+	var size int
+	switch header[3] {
+	case socksAtypIPv4:
+		size = net.IPv4len
+	case socksAtypIPv6:
+		size = net.IPv6len
+	case socksAtypDomain:
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return err
+		}
+		size = int(b[0])
+	default:
+		return fmt.Errorf("unsupported address type: %d", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, size+2))
+
+	return err
+}
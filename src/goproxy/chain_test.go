@@ -0,0 +1,356 @@
+package goproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"mitmgo/src/core"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 测试用的上游代理, 统计收到的连接数
+type fakeProxy struct {
+	l       net.Listener
+	accepts int32
+}
+
+func startFakeProxy(t *testing.T, handle func(conn net.Conn)) *fakeProxy {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &fakeProxy{l: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&proxy.accepts, 1)
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+
+	return proxy
+}
+
+func (p *fakeProxy) Accepts() int {
+	return int(atomic.LoadInt32(&p.accepts))
+}
+
+func (p *fakeProxy) URL(scheme string, userinfo string) string {
+	if len(userinfo) > 0 {
+		userinfo += "@"
+	}
+	return scheme + "://" + userinfo + p.l.Addr().String()
+}
+
+// 连接目标后双向转发, r中可能有已经读取的数据
+func relayTo(conn net.Conn, r io.Reader, addr string) {
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+	defer target.Close()
+
+	go io.Copy(target, r)
+	io.Copy(conn, target)
+}
+
+// 接受连接后直接关闭
+func closeConn(conn net.Conn) {}
+
+// HTTP CONNECT代理, credential不为空时要求Basic认证
+func httpConnectProxy(credential string) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil || req.Method != "CONNECT" {
+			return
+		}
+		if len(credential) > 0 && req.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte(credential)) {
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		relayTo(conn, br, req.Host)
+	}
+}
+
+// SOCKS5代理, user不为空时要求用户名密码认证
+func socks5Proxy(user string, password string) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(br, header); err != nil {
+			return
+		}
+		methods := make([]byte, header[1])
+		if _, err := io.ReadFull(br, methods); err != nil {
+			return
+		}
+		want := byte(socksAuthNone)
+		if len(user) > 0 {
+			want = socksAuthPassword
+		}
+		found := false
+		for _, m := range methods {
+			found = found || m == want
+		}
+		if !found {
+			conn.Write([]byte{socksVersion, socksAuthNoAcceptable})
+			return
+		}
+		conn.Write([]byte{socksVersion, want})
+
+		readString := func() string {
+			size, err := br.ReadByte()
+			if err != nil {
+				return ""
+			}
+			b := make([]byte, size)
+			io.ReadFull(br, b)
+			return string(b)
+		}
+		if want == socksAuthPassword {
+			br.ReadByte()
+			if readString() != user || readString() != password {
+				conn.Write([]byte{socksPasswordVersion, 1})
+				return
+			}
+			conn.Write([]byte{socksPasswordVersion, 0})
+		}
+
+		request := make([]byte, 4)
+		if _, err := io.ReadFull(br, request); err != nil {
+			return
+		}
+		var host string
+		switch request[3] {
+		case socksAtypIPv4:
+			ip := make([]byte, net.IPv4len)
+			io.ReadFull(br, ip)
+			host = net.IP(ip).String()
+		case socksAtypIPv6:
+			ip := make([]byte, net.IPv6len)
+			io.ReadFull(br, ip)
+			host = net.IP(ip).String()
+		case socksAtypDomain:
+			host = readString()
+		}
+		port := make([]byte, 2)
+		if _, err := io.ReadFull(br, port); err != nil {
+			return
+		}
+
+		conn.Write([]byte{socksVersion, socksRepSucceeded, 0, socksAtypIPv4, 127, 0, 0, 1, 0, 0})
+		relayTo(conn, br, net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+	}
+}
+
+func newChainProxyEntity(t *testing.T, proxies ...string) *ProxyEntity {
+	t.Helper()
+
+	p := newTestProxyEntity()
+	var err error
+	p.upstreamProxies, err = core.NewUpstreamProxies([]core.UpstreamProxyRule{{Proxies: proxies}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.upstreamTLS, err = core.NewUpstreamTLS(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+// 通过连接发送数据, 检查回显的内容
+func checkEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+		t.Fatalf("echo = %q, %v", b, err)
+	}
+}
+
+func (p *ProxyEntity) isProxyDown(proxy string) bool {
+	p.lock_proxyFailures.Lock()
+	defer p.lock_proxyFailures.Unlock()
+
+	_, ok := p.proxyFailures[proxy]
+	return ok
+}
+
+func TestDialUpstreamFailover(t *testing.T) {
+	target := echoServer(t)
+	defer target.Close()
+
+	broken := startFakeProxy(t, closeConn)
+	good := startFakeProxy(t, httpConnectProxy(""))
+	p := newChainProxyEntity(t, broken.URL("http", ""), good.URL("http", ""))
+	brokenName := broken.URL("http", "")
+
+	dial := func() {
+		t.Helper()
+		conn, err := p.dialUpstream(context.Background(), "tcp", target.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkEcho(t, conn)
+	}
+
+	// 第一个代理不可用时使用下一个
+	dial()
+	if broken.Accepts() != 1 || good.Accepts() != 1 {
+		t.Fatalf("accepts = %d, %d, want 1, 1", broken.Accepts(), good.Accepts())
+	}
+	if !p.isProxyDown(brokenName) || p.isProxyDown(good.URL("http", "")) {
+		t.Fatal("only the broken proxy should be marked down")
+	}
+
+	// 冷却期内排在后面
+	dial()
+	if broken.Accepts() != 1 || good.Accepts() != 2 {
+		t.Fatalf("accepts = %d, %d, want 1, 2", broken.Accepts(), good.Accepts())
+	}
+
+	// 冷却期过后按原来的顺序尝试
+	p.lock_proxyFailures.Lock()
+	p.proxyFailures[brokenName] = time.Now().Add(-upstreamProxyCooldown - time.Second)
+	p.lock_proxyFailures.Unlock()
+	dial()
+	if broken.Accepts() != 2 || good.Accepts() != 3 {
+		t.Fatalf("accepts = %d, %d, want 2, 3", broken.Accepts(), good.Accepts())
+	}
+}
+
+func TestDialUpstreamAllDown(t *testing.T) {
+	target := echoServer(t)
+	defer target.Close()
+
+	first := startFakeProxy(t, closeConn)
+	second := startFakeProxy(t, closeConn)
+	p := newChainProxyEntity(t, first.URL("http", ""), second.URL("socks5", ""))
+
+	if _, err := p.dialUpstream(context.Background(), "tcp", target.Addr().String()); err == nil {
+		t.Fatal("dialUpstream should fail")
+	}
+	if !p.isProxyDown(first.URL("http", "")) || !p.isProxyDown(second.URL("socks5", "")) {
+		t.Fatal("the proxies are not marked down")
+	}
+
+	// 全部不可用时仍然按原来的顺序尝试
+	proxies := p.orderProxies(p.upstreamProxies.ProxiesFor(target.Addr().String()))
+	if proxyName(proxies[0]) != first.URL("http", "") {
+		t.Fatalf("the first proxy = %s", proxyName(proxies[0]))
+	}
+
+	// direct作为最后的选择
+	p = newChainProxyEntity(t, first.URL("http", ""), core.UpstreamDirect)
+	conn, err := p.dialUpstream(context.Background(), "tcp", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, conn)
+}
+
+// 代理拒绝请求时代理本身可用, 不标记为不可用
+func TestDialUpstreamRejected(t *testing.T) {
+	target := echoServer(t)
+	defer target.Close()
+
+	rejecting := startFakeProxy(t, httpConnectProxy("user:pass"))
+	good := startFakeProxy(t, httpConnectProxy(""))
+	p := newChainProxyEntity(t, rejecting.URL("http", "user:wrong"), good.URL("http", ""))
+
+	conn, err := p.dialUpstream(context.Background(), "tcp", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, conn)
+	if rejecting.Accepts() != 1 || good.Accepts() != 1 {
+		t.Fatalf("accepts = %d, %d, want 1, 1", rejecting.Accepts(), good.Accepts())
+	}
+	if len(p.proxyFailures) != 0 {
+		t.Fatalf("proxy failures = %v", p.proxyFailures)
+	}
+
+	// 下一次仍然先尝试
+	p = newChainProxyEntity(t, rejecting.URL("http", "user:wrong"))
+	_, err = p.dialUpstream(context.Background(), "tcp", target.Addr().String())
+	if _, ok := err.(*proxyRejectedError); !ok {
+		t.Fatalf("error = %v, want a proxyRejectedError", err)
+	}
+	if len(p.proxyFailures) != 0 {
+		t.Fatalf("proxy failures = %v", p.proxyFailures)
+	}
+}
+
+func TestDialViaAuth(t *testing.T) {
+	target := echoServer(t)
+	defer target.Close()
+	_, port, _ := net.SplitHostPort(target.Addr().String())
+
+	httpProxy := startFakeProxy(t, httpConnectProxy("user:p@ss:word"))
+	socksProxy := startFakeProxy(t, socks5Proxy("user", "p@ss"))
+	socksNoAuth := startFakeProxy(t, socks5Proxy("", ""))
+
+	tests := []struct {
+		name     string
+		proxy    string
+		addr     string
+		rejected bool
+	}{
+		{"http", httpProxy.URL("http", "user:p%40ss:word"), target.Addr().String(), false},
+		{"http wrong password", httpProxy.URL("http", "user:wrong"), target.Addr().String(), true},
+		{"http without credential", httpProxy.URL("http", ""), target.Addr().String(), true},
+		{"socks5", socksProxy.URL("socks5", "user:p%40ss"), target.Addr().String(), false},
+		{"socks5 wrong password", socksProxy.URL("socks5", "user:wrong"), target.Addr().String(), true},
+		{"socks5 without credential", socksProxy.URL("socks5", ""), target.Addr().String(), true},
+		{"socks5h domain", socksProxy.URL("socks5h", "user:p%40ss"), net.JoinHostPort("localhost", port), false},
+		{"socks5 without auth", socksNoAuth.URL("socks5", ""), target.Addr().String(), false},
+		{"socks5 credential not required", socksNoAuth.URL("socks5", "user:pass"), target.Addr().String(), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy, err := core.ParseUpstreamProxyURL(tt.proxy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := newChainProxyEntity(t, tt.proxy)
+
+			conn, err := p.dialVia(context.Background(), proxy, "tcp", tt.addr)
+			if tt.rejected {
+				if _, ok := err.(*proxyRejectedError); !ok {
+					t.Fatalf("error = %v, want a proxyRejectedError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkEcho(t, conn)
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package goproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// TLS扩展类型
+const (
+	extensionServerName          uint16 = 0
+	extensionSupportedGroups     uint16 = 10
+	extensionPointFormats        uint16 = 11
+	extensionSignatureAlgorithms uint16 = 13
+	extensionALPN                uint16 = 16
+	extensionSupportedVersions   uint16 = 43
+)
+
+// 最大的ClientHello长度, 避免恶意的客户端占用内存
+const maxClientHelloSize = 64 * 1024
+
+var errInvalidClientHello = errors.New("invalid client hello")
+
+// 解析后的ClientHello
+type clientHello struct {
+	Version             uint16
+	CipherSuites        []uint16
+	Extensions          []uint16 // 按客户端发送的顺序
+	ServerName          string
+	ALPN                []string
+	SupportedGroups     []uint16
+	PointFormats        []uint8
+	SignatureAlgorithms []uint16
+	SupportedVersions   []uint16
+}
+
+// 读取完整的ClientHello, 返回读取的原始数据(包含记录头)用于重放
+func readClientHello(r io.Reader) ([]byte, *clientHello, error) {
+	var raw []byte
+	var msg []byte
+
+	for {
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return raw, nil, err
+		}
+		raw = append(raw, header...)
+		if header[0] != 22 {
+			return raw, nil, errInvalidClientHello
+		}
+
+		length := int(binary.BigEndian.Uint16(header[3:5]))
+		if len(raw)+length > maxClientHelloSize {
+			return raw, nil, errInvalidClientHello
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return raw, nil, err
+		}
+		raw = append(raw, payload...)
+		msg = append(msg, payload...)
+
+		// 握手消息可能跨多个记录
+		if len(msg) >= 4 {
+			msgLength := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+			if len(msg) >= 4+msgLength {
+				if msg[0] != 1 {
+					return raw, nil, errInvalidClientHello
+				}
+				hello, err := parseClientHello(msg[4 : 4+msgLength])
+				return raw, hello, err
+			}
+		}
+	}
+}
+
+// 按长度前缀读取数据
+type helloReader struct {
+	data []byte
+	err  bool
+}
+
+func (p *helloReader) bytes(n int) []byte {
+	if p.err || n > len(p.data) {
+		p.err = true
+		return nil
+	}
+	b := p.data[:n]
+	p.data = p.data[n:]
+
+	return b
+}
+
+func (p *helloReader) uint8() uint8 {
+	b := p.bytes(1)
+	if b == nil {
+		return 0
+	}
+
+	return b[0]
+}
+
+func (p *helloReader) uint16() uint16 {
+	b := p.bytes(2)
+	if b == nil {
+		return 0
+	}
+
+	return binary.BigEndian.Uint16(b)
+}
+
+func (p *helloReader) vector8() *helloReader {
+	return &helloReader{data: p.bytes(int(p.uint8())), err: p.err}
+}
+
+func (p *helloReader) vector16() *helloReader {
+	return &helloReader{data: p.bytes(int(p.uint16())), err: p.err}
+}
+
+func (p *helloReader) uint16List() []uint16 {
+	list := make([]uint16, 0, len(p.data)/2)
+	for len(p.data) >= 2 && !p.err {
+		list = append(list, p.uint16())
+	}
+
+	return list
+}
+
+func parseClientHello(body []byte) (*clientHello, error) {
+	r := &helloReader{data: body}
+	hello := &clientHello{}
+
+	hello.Version = r.uint16()
+	r.bytes(32) // random
+	r.vector8() // session id
+	hello.CipherSuites = r.vector16().uint16List()
+	r.vector8() // compression methods
+	if r.err {
+		return nil, errInvalidClientHello
+	}
+
+	// 没有扩展
+	if len(r.data) == 0 {
+		return hello, nil
+	}
+
+	extensions := r.vector16()
+	for len(extensions.data) > 0 && !extensions.err {
+		extType := extensions.uint16()
+		data := extensions.vector16()
+		if extensions.err || data.err {
+			return nil, errInvalidClientHello
+		}
+		hello.Extensions = append(hello.Extensions, extType)
+
+		switch extType {
+		case extensionServerName:
+			names := data.vector16()
+			for len(names.data) > 0 && !names.err {
+				nameType := names.uint8()
+				name := names.vector16()
+				if nameType == 0 && !name.err {
+					hello.ServerName = string(name.data)
+				}
+			}
+		case extensionSupportedGroups:
+			hello.SupportedGroups = data.vector16().uint16List()
+		case extensionPointFormats:
+			hello.PointFormats = append([]uint8{}, data.vector8().data...)
+		case extensionSignatureAlgorithms:
+			hello.SignatureAlgorithms = data.vector16().uint16List()
+		case extensionALPN:
+			protos := data.vector16()
+			for len(protos.data) > 0 && !protos.err {
+				proto := protos.vector8()
+				if !proto.err {
+					hello.ALPN = append(hello.ALPN, string(proto.data))
+				}
+			}
+		case extensionSupportedVersions:
+			hello.SupportedVersions = data.vector8().uint16List()
+		}
+	}
+	if extensions.err {
+		return nil, errInvalidClientHello
+	}
+
+	return hello, nil
+}
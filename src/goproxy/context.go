@@ -0,0 +1,93 @@
+package goproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/google/martian/v3"
+	"net/http"
+	"sync"
+)
+
+// 一次请求的上下文, ModifyRequest中保存的状态在ModifyResponse中读取
+// martian处理的请求使用martian的上下文, h2的请求使用requestState
+type requestContext interface {
+	ID() string
+	Get(key string) (interface{}, bool)
+	Set(key string, val interface{})
+	SkipRoundTrip()
+}
+
+type requestStateKey struct{}
+
+// 不经过martian的请求的上下文, 保存在req.Context()中
+type requestState struct {
+	id            string
+	vals          map[string]interface{}
+	skipRoundTrip bool
+	lock_vals     sync.Mutex
+}
+
+func newRequestState() *requestState {
+	b := make([]byte, 8)
+	rand.Read(b)
+
+	return &requestState{
+		id:   hex.EncodeToString(b),
+		vals: make(map[string]interface{}),
+	}
+}
+
+func (p *requestState) ID() string {
+	return p.id
+}
+
+func (p *requestState) Get(key string) (interface{}, bool) {
+	p.lock_vals.Lock()
+	defer p.lock_vals.Unlock()
+
+	v, ok := p.vals[key]
+	return v, ok
+}
+
+func (p *requestState) Set(key string, val interface{}) {
+	p.lock_vals.Lock()
+	defer p.lock_vals.Unlock()
+
+	p.vals[key] = val
+}
+
+func (p *requestState) SkipRoundTrip() {
+	p.lock_vals.Lock()
+	defer p.lock_vals.Unlock()
+
+	p.skipRoundTrip = true
+}
+
+func (p *requestState) SkippingRoundTrip() bool {
+	p.lock_vals.Lock()
+	defer p.lock_vals.Unlock()
+
+	return p.skipRoundTrip
+}
+
+// 返回带有新上下文的请求
+func withRequestState(req *http.Request) (*http.Request, *requestState) {
+	state := newRequestState()
+	return req.WithContext(context.WithValue(req.Context(), requestStateKey{}, state)), state
+}
+
+// 获取请求的上下文, 没有时返回nil
+func contextOf(req *http.Request) requestContext {
+	if req == nil {
+		return nil
+	}
+	if ctx := martian.NewContext(req); ctx != nil {
+		return ctx
+	}
+	if state, ok := req.Context().Value(requestStateKey{}).(*requestState); ok {
+		return state
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+package goproxy
+
+import (
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// 结果被过滤的原因
+const (
+	FilterReasonMethod            = "method"              // 请求方法不在 --methods 中
+	FilterReasonScope             = "scope"               // 不在范围内
+	FilterReasonDuplicate         = "duplicate"           // 重复的请求
+	FilterReasonStaticExtension   = "static-extension"    // 静态资源的扩展名
+	FilterReasonStaticContentType = "static-content-type" // 静态资源的Content-Type
+)
+
+// 静态资源的Content-Type, 以/结尾的按前缀匹配
+var staticContentType = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/",
+	"text/css",
+	"text/javascript",
+	"application/javascript",
+	"application/x-javascript",
+	"application/ecmascript",
+	"application/font-woff",
+	"application/font-woff2",
+	"application/x-font-ttf",
+	"application/vnd.ms-fontobject",
+	"application/zip",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/pdf",
+}
+
+// 合并内置的和自定义的静态资源扩展名
+func (p *ProxyEntity) initStaticFilter() {
+	p.staticExtensions = make(map[string]struct{})
+	p.staticContentTypes = make([]string, 0)
+	if p.IsKeepStatic {
+		return
+	}
+
+	for k, v := range mediaType {
+		p.staticExtensions[k] = v
+	}
+	for _, ext := range p.StaticExtensions {
+		ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		if len(ext) > 0 {
+			p.staticExtensions[ext] = struct{}{}
+		}
+	}
+
+	p.staticContentTypes = append(p.staticContentTypes, staticContentType...)
+	for _, contentType := range p.StaticContentTypes {
+		contentType = strings.ToLower(strings.TrimSpace(contentType))
+		if len(contentType) > 0 {
+			p.staticContentTypes = append(p.staticContentTypes, contentType)
+		}
+	}
+}
+
+func (p *ProxyEntity) isStaticExtension(urlPath string) bool {
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(urlPath), "."))
+	if len(ext) == 0 {
+		return false
+	}
+
+	_, ok := p.staticExtensions[ext]
+	return ok
+}
+
+func (p *ProxyEntity) isStaticContentType(res *http.Response) bool {
+	v := res.Header.Get("Content-Type")
+	if len(v) == 0 {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(v)
+	if err != nil {
+		return false
+	}
+
+	for _, contentType := range p.staticContentTypes {
+		if strings.HasSuffix(contentType, "/") {
+			if strings.HasPrefix(mediaType, contentType) {
+				return true
+			}
+		} else if mediaType == contentType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// 记录被过滤的数量
+func (p *ProxyEntity) countFiltered(reason string) {
+	p.lock_filterStats.Lock()
+	defer p.lock_filterStats.Unlock()
+
+	p.filterStats[reason]++
+}
+
+// 按原因统计被过滤的数量
+func (p *ProxyEntity) FilterStats() map[string]int64 {
+	p.lock_filterStats.Lock()
+	defer p.lock_filterStats.Unlock()
+
+	result := make(map[string]int64)
+	for k, v := range p.filterStats {
+		result[k] = v
+	}
+
+	return result
+}
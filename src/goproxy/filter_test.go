@@ -0,0 +1,160 @@
+package goproxy
+
+import (
+	"io"
+	"mitmgo/src/core"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIsStaticExtension(t *testing.T) {
+	p := newTestProxyEntity()
+	p.StaticExtensions = []string{".MAP", " txt ", ""}
+	p.initStaticFilter()
+
+	tests := []struct {
+		path   string
+		static bool
+	}{
+		{"/logo.png", true},
+		{"/LOGO.PNG", true},
+		{"/static/app.min.js", true},
+		{"/a.js/detail", false},
+		{"/app.js.map", true},
+		{"/robots.txt", true},
+		{"/api/users", false},
+		{"/api/users.json", false},
+		{"/download.", false},
+		{"/", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if static := p.isStaticExtension(tt.path); static != tt.static {
+			t.Errorf("isStaticExtension(%q) = %v, want %v", tt.path, static, tt.static)
+		}
+	}
+
+	// 保留静态资源时不过滤
+	p.IsKeepStatic = true
+	p.initStaticFilter()
+	if p.isStaticExtension("/logo.png") || p.isStaticExtension("/app.js.map") {
+		t.Error("static resources are filtered with IsKeepStatic")
+	}
+}
+
+func TestIsStaticContentType(t *testing.T) {
+	p := newTestProxyEntity()
+	p.StaticContentTypes = []string{" Application/WASM ", "model/"}
+	p.initStaticFilter()
+
+	tests := []struct {
+		contentType string
+		static      bool
+	}{
+		{"image/png", true},
+		{"IMAGE/SVG+XML", true},
+		{"font/woff2", true},
+		{"text/css; charset=utf-8", true},
+		{"application/javascript", true},
+		{"application/wasm", true},
+		{"model/gltf+json", true},
+		{"text/html; charset=utf-8", false},
+		{"application/json", false},
+		{"text/javascript-like", false},
+		{"imagex/png", false},
+		{"image", false},
+		{"", false},
+		{"image/png; =invalid", false},
+	}
+	for _, tt := range tests {
+		res := &http.Response{Header: http.Header{}}
+		if len(tt.contentType) > 0 {
+			res.Header.Set("Content-Type", tt.contentType)
+		}
+		if static := p.isStaticContentType(res); static != tt.static {
+			t.Errorf("isStaticContentType(%q) = %v, want %v", tt.contentType, static, tt.static)
+		}
+	}
+
+	p.IsKeepStatic = true
+	p.initStaticFilter()
+	res := &http.Response{Header: http.Header{"Content-Type": {"image/png"}}}
+	if p.isStaticContentType(res) {
+		t.Error("static resources are filtered with IsKeepStatic")
+	}
+}
+
+// 请求经过ModifyRequest和captureResponse, 读取完响应体后输出结果
+func roundTripFlow(t *testing.T, p *ProxyEntity, method string, link string, contentType string) {
+	t.Helper()
+
+	req, state := withRequestState(httptest.NewRequest(method, link, nil))
+	if err := p.ModifyRequest(req); err != nil {
+		t.Fatal(err)
+	}
+
+	res := &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": {contentType}},
+		Body:       io.NopCloser(strings.NewReader("body")),
+		Request:    req,
+	}
+	p.captureResponse(state, res)
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+}
+
+func TestFilterStats(t *testing.T) {
+	p := newTestProxyEntity()
+	p.Methods = []string{"GET", "POST"}
+	p.initStaticFilter()
+	var err error
+	p.scope, err = core.NewScope(&core.ScopeConfig{Exclude: []core.ScopeRule{{Hosts: []string{"ads.example.com"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roundTripFlow(t, p, "GET", "http://example.com/api/users", "application/json")
+	roundTripFlow(t, p, "GET", "http://example.com/api/users", "application/json")
+	roundTripFlow(t, p, "DELETE", "http://example.com/api/users", "application/json")
+	roundTripFlow(t, p, "GET", "http://ads.example.com/track", "application/json")
+	roundTripFlow(t, p, "GET", "http://example.com/logo.png", "image/png")
+	// 没有扩展名的静态资源, 重复的请求仍然按Content-Type统计
+	roundTripFlow(t, p, "GET", "http://example.com/avatar?id=1", "image/jpeg")
+	roundTripFlow(t, p, "GET", "http://example.com/avatar?id=1", "image/jpeg")
+	roundTripFlow(t, p, "GET", "http://example.com/avatar?id=1", "image/jpeg")
+
+	want := map[string]int64{
+		FilterReasonDuplicate:         1,
+		FilterReasonMethod:            1,
+		FilterReasonScope:             1,
+		FilterReasonStaticExtension:   1,
+		FilterReasonStaticContentType: 3,
+	}
+	stats := p.FilterStats()
+	if len(stats) != len(want) {
+		t.Fatalf("stats = %v, want %v", stats, want)
+	}
+	for reason, count := range want {
+		if stats[reason] != count {
+			t.Errorf("stats[%s] = %d, want %d", reason, stats[reason], count)
+		}
+	}
+	if p.ResultSet.Count() != 1 {
+		t.Fatalf("%d results, want 1", p.ResultSet.Count())
+	}
+
+	// 接口返回的是副本
+	stats[FilterReasonDuplicate] = 100
+	if p.FilterStats()[FilterReasonDuplicate] != 1 {
+		t.Fatal("FilterStats returned the internal map")
+	}
+
+	// 同一个地址的响应不再是静态资源时作为结果
+	roundTripFlow(t, p, "GET", "http://example.com/avatar?id=1", "text/html")
+	if p.ResultSet.Count() != 2 {
+		t.Fatalf("%d results, want 2", p.ResultSet.Count())
+	}
+}
@@ -0,0 +1,211 @@
+package goproxy
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"mitmgo/src/core"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// GREASE值, 客户端随机插入用于检测服务端兼容性, 计算指纹时忽略
+// https://tools.ietf.org/html/rfc8701
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	result := make([]uint16, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(v) {
+			result = append(result, v)
+		}
+	}
+
+	return result
+}
+
+func joinDecimal(values []uint16) string {
+	items := make([]string, len(values))
+	for i, v := range values {
+		items[i] = strconv.Itoa(int(v))
+	}
+
+	return strings.Join(items, "-")
+}
+
+func joinHex(values []uint16) string {
+	items := make([]string, len(values))
+	for i, v := range values {
+		items[i] = fmt.Sprintf("%04x", v)
+	}
+
+	return strings.Join(items, ",")
+}
+
+// JA3: SSLVersion,Ciphers,Extensions,EllipticCurves,EllipticCurvePointFormats
+// https://github.com/salesforce/ja3
+func (p *clientHello) JA3() string {
+	formats := make([]uint16, len(p.PointFormats))
+	for i, v := range p.PointFormats {
+		formats[i] = uint16(v)
+	}
+
+	return strings.Join([]string{
+		strconv.Itoa(int(p.Version)),
+		joinDecimal(withoutGREASE(p.CipherSuites)),
+		joinDecimal(withoutGREASE(p.Extensions)),
+		joinDecimal(withoutGREASE(p.SupportedGroups)),
+		joinDecimal(formats),
+	}, ",")
+}
+
+func (p *clientHello) JA3Hash() string {
+	h := md5.Sum([]byte(p.JA3()))
+	return hex.EncodeToString(h[:])
+}
+
+func ja4Version(version uint16) string {
+	switch version {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	case 0x0002:
+		return "s2"
+	}
+
+	return "00"
+}
+
+func isAlphanumeric(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// 第一个ALPN的首尾字符, 不是字母数字时使用十六进制的首尾字符
+func ja4ALPN(alpn []string) string {
+	if len(alpn) == 0 || len(alpn[0]) == 0 {
+		return "00"
+	}
+
+	proto := alpn[0]
+	first, last := proto[0], proto[len(proto)-1]
+	if isAlphanumeric(first) && isAlphanumeric(last) {
+		return string([]byte{first, last})
+	}
+
+	h := hex.EncodeToString([]byte(proto))
+	return string([]byte{h[0], h[len(h)-1]})
+}
+
+func ja4Count(n int) string {
+	if n > 99 {
+		n = 99
+	}
+
+	return fmt.Sprintf("%02d", n)
+}
+
+// sha256的前12个十六进制字符, 内容为空时为12个0
+func ja4Hash(s string) string {
+	if len(s) == 0 {
+		return "000000000000"
+	}
+	h := sha256.Sum256([]byte(s))
+
+	return hex.EncodeToString(h[:])[:12]
+}
+
+// JA4, 只计算TCP上的TLS
+// https://github.com/FoxIO-LLC/ja4/blob/main/technical_details/JA4.md
+func (p *clientHello) JA4() string {
+	// 有supported_versions扩展时使用其中的最高版本
+	version := p.Version
+	if versions := withoutGREASE(p.SupportedVersions); len(versions) > 0 {
+		version = versions[0]
+		for _, v := range versions {
+			if v > version {
+				version = v
+			}
+		}
+	}
+
+	sni := "i"
+	if len(p.ServerName) > 0 {
+		sni = "d"
+	}
+
+	ciphers := withoutGREASE(p.CipherSuites)
+	extensions := withoutGREASE(p.Extensions)
+
+	sortedCiphers := append([]uint16{}, ciphers...)
+	sort.Slice(sortedCiphers, func(i, j int) bool { return sortedCiphers[i] < sortedCiphers[j] })
+
+	// 排序后的扩展不包含SNI和ALPN
+	sortedExtensions := make([]uint16, 0, len(extensions))
+	for _, ext := range extensions {
+		if ext != extensionServerName && ext != extensionALPN {
+			sortedExtensions = append(sortedExtensions, ext)
+		}
+	}
+	sort.Slice(sortedExtensions, func(i, j int) bool { return sortedExtensions[i] < sortedExtensions[j] })
+
+	// 没有签名算法时不带下划线和签名算法部分
+	extensionsStr := joinHex(sortedExtensions)
+	if len(p.SignatureAlgorithms) > 0 {
+		extensionsStr += "_" + joinHex(p.SignatureAlgorithms)
+	}
+
+	return "t" + ja4Version(version) + sni + ja4Count(len(ciphers)) + ja4Count(len(extensions)) + ja4ALPN(p.ALPN) +
+		"_" + ja4Hash(joinHex(sortedCiphers)) +
+		"_" + ja4Hash(extensionsStr)
+}
+
+func (p *clientHello) tlsInfo() *core.ClientTLSInfo {
+	return &core.ClientTLSInfo{
+		SNI:     p.ServerName,
+		ALPN:    p.ALPN,
+		JA3:     p.JA3(),
+		JA3Hash: p.JA3Hash(),
+		JA4:     p.JA4(),
+	}
+}
+
+// 记录解密连接的客户端TLS信息, 按客户端地址查找
+func (p *ProxyEntity) addClientHello(addr string, hello *clientHello) {
+	info := hello.tlsInfo()
+
+	p.lock_clientHellos.Lock()
+	defer p.lock_clientHellos.Unlock()
+
+	p.clientHellos[addr] = info
+}
+
+func (p *ProxyEntity) removeClientHello(addr string) {
+	p.lock_clientHellos.Lock()
+	defer p.lock_clientHellos.Unlock()
+
+	delete(p.clientHellos, addr)
+}
+
+// 请求所在连接的客户端TLS信息, 不是解密的https请求时返回nil
+func (p *ProxyEntity) clientTLSInfo(req *http.Request) *core.ClientTLSInfo {
+	if req.TLS == nil {
+		return nil
+	}
+
+	p.lock_clientHellos.Lock()
+	defer p.lock_clientHellos.Unlock()
+
+	return p.clientHellos[req.RemoteAddr]
+}
@@ -0,0 +1,219 @@
+package goproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// 构造测试用的ClientHello
+type testHello struct {
+	version    uint16
+	ciphers    []uint16
+	extensions []uint16 // 按发送顺序, 下面的字段填充对应扩展的内容
+	serverName string
+	alpn       []string
+	groups     []uint16
+	formats    []uint8
+	sigAlgs    []uint16
+	versions   []uint16
+}
+
+func appendVector16(b []byte, data []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+	return append(b, data...)
+}
+
+func appendUint16s(b []byte, values []uint16) []byte {
+	for _, v := range values {
+		b = binary.BigEndian.AppendUint16(b, v)
+	}
+	return b
+}
+
+// 完整的握手记录
+func (h *testHello) record() []byte {
+	var exts []byte
+	for _, ext := range h.extensions {
+		var data []byte
+		switch ext {
+		case extensionServerName:
+			name := append([]byte{0}, appendVector16(nil, []byte(h.serverName))...)
+			data = appendVector16(nil, name)
+		case extensionSupportedGroups:
+			data = appendVector16(nil, appendUint16s(nil, h.groups))
+		case extensionPointFormats:
+			data = append([]byte{byte(len(h.formats))}, h.formats...)
+		case extensionSignatureAlgorithms:
+			data = appendVector16(nil, appendUint16s(nil, h.sigAlgs))
+		case extensionALPN:
+			var protos []byte
+			for _, proto := range h.alpn {
+				protos = append(protos, byte(len(proto)))
+				protos = append(protos, proto...)
+			}
+			data = appendVector16(nil, protos)
+		case extensionSupportedVersions:
+			versions := appendUint16s(nil, h.versions)
+			data = append([]byte{byte(len(versions))}, versions...)
+		}
+		exts = binary.BigEndian.AppendUint16(exts, ext)
+		exts = appendVector16(exts, data)
+	}
+
+	body := binary.BigEndian.AppendUint16(nil, h.version)
+	body = append(body, make([]byte, 32)...) // random
+	body = append(body, 0)                   // session id
+	body = appendVector16(body, appendUint16s(nil, h.ciphers))
+	body = append(body, 1, 0) // compression methods
+	body = appendVector16(body, exts)
+
+	msg := []byte{1, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+	msg = append(msg, body...)
+
+	record := []byte{22, 3, 1}
+	return appendVector16(record, msg)
+}
+
+func parseTestHello(t *testing.T, h *testHello) *clientHello {
+	t.Helper()
+
+	raw := h.record()
+	read, hello, err := readClientHello(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("failed to parse the client hello: %v", err)
+	}
+	if !bytes.Equal(read, raw) {
+		t.Fatal("the returned raw data is different from the input")
+	}
+
+	return hello
+}
+
+// https://github.com/salesforce/ja3 中的示例
+func TestJA3(t *testing.T) {
+	hello := parseTestHello(t, &testHello{
+		version:    769,
+		ciphers:    []uint16{0x0a0a, 47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4},
+		extensions: []uint16{0x1a1a, extensionServerName, extensionSupportedGroups, extensionPointFormats},
+		serverName: "example.com",
+		groups:     []uint16{0x2a2a, 23, 24, 25},
+		formats:    []uint8{0},
+	})
+
+	want := "769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0"
+	if ja3 := hello.JA3(); ja3 != want {
+		t.Fatalf("JA3 = %q, want %q", ja3, want)
+	}
+	if hash := hello.JA3Hash(); hash != "ada70206e40642a3e4461f35503241d5" {
+		t.Fatalf("JA3 hash = %q", hash)
+	}
+}
+
+// https://github.com/FoxIO-LLC/ja4/blob/main/technical_details/JA4.md 中的示例
+func TestJA4(t *testing.T) {
+	chrome := &testHello{
+		version: 0x0303,
+		ciphers: []uint16{
+			0x3a3a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030,
+			0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035,
+		},
+		extensions: []uint16{
+			0x4a4a, 0x0017, 0x002d, 0x000b, 0xff01, 0x0023, 0x0012, extensionALPN, 0x0005,
+			extensionServerName, 0x001b, 0x4469, extensionSupportedVersions, 0x0033,
+			extensionSignatureAlgorithms, extensionSupportedGroups, 0x0015, 0x5a5a,
+		},
+		serverName: "www.example.com",
+		alpn:       []string{"h2", "http/1.1"},
+		groups:     []uint16{0x6a6a, 0x001d, 0x0017, 0x0018},
+		formats:    []uint8{0},
+		sigAlgs:    []uint16{0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601},
+		versions:   []uint16{0x7a7a, 0x0304, 0x0303},
+	}
+
+	tests := []struct {
+		name  string
+		hello func() *testHello
+		ja4   string
+	}{
+		{
+			name:  "chrome",
+			hello: func() *testHello { return chrome },
+			ja4:   "t13d1516h2_8daaf6152771_e5627efa2ab1",
+		},
+		{
+			name: "no sni",
+			hello: func() *testHello {
+				h := *chrome
+				h.extensions = []uint16{}
+				for _, ext := range chrome.extensions {
+					if ext != extensionServerName {
+						h.extensions = append(h.extensions, ext)
+					}
+				}
+				return &h
+			},
+			ja4: "t13i1515h2_8daaf6152771_e5627efa2ab1",
+		},
+		{
+			name: "only sni and alpn",
+			hello: func() *testHello {
+				h := *chrome
+				h.version = 0x0303
+				h.ciphers = []uint16{0xc02f}
+				h.extensions = []uint16{extensionServerName, extensionALPN}
+				h.alpn = []string{"http/1.1"}
+				return &h
+			},
+			ja4: "t12d0102h1_" + ja4Hash("c02f") + "_000000000000",
+		},
+		{
+			name: "no extensions",
+			hello: func() *testHello {
+				return &testHello{version: 0x0301, ciphers: []uint16{0x002f, 0x000a}}
+			},
+			ja4: "t10i020000_" + ja4Hash("000a,002f") + "_000000000000",
+		},
+		{
+			name: "non alphanumeric alpn",
+			hello: func() *testHello {
+				h := *chrome
+				h.alpn = []string{"\xabx\xcd"}
+				return &h
+			},
+			ja4: "t13d1516ad_8daaf6152771_e5627efa2ab1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hello := parseTestHello(t, tt.hello())
+			if ja4 := hello.JA4(); ja4 != tt.ja4 {
+				t.Fatalf("JA4 = %q, want %q", ja4, tt.ja4)
+			}
+		})
+	}
+}
+
+// 签名算法只在没有签名算法时省略, 与是否有其他扩展无关
+func TestJA4SignatureAlgorithms(t *testing.T) {
+	hello := &clientHello{
+		Version:             0x0303,
+		CipherSuites:        []uint16{0xc02f},
+		Extensions:          []uint16{extensionServerName, extensionALPN},
+		ServerName:          "example.com",
+		ALPN:                []string{"h2"},
+		SignatureAlgorithms: []uint16{0x0403, 0x0804},
+	}
+
+	want := "t12d0102h2_" + ja4Hash("c02f") + "_" + ja4Hash("_0403,0804")
+	if ja4 := hello.JA4(); ja4 != want {
+		t.Fatalf("JA4 = %q, want %q", ja4, want)
+	}
+
+	hello.SignatureAlgorithms = nil
+	want = "t12d0102h2_" + ja4Hash("c02f") + "_000000000000"
+	if ja4 := hello.JA4(); ja4 != want {
+		t.Fatalf("JA4 = %q, want %q", ja4, want)
+	}
+}
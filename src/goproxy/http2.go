@@ -0,0 +1,124 @@
+package goproxy
+
+import (
+	"github.com/google/martian/v3/proxyutil"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// 逐跳的请求头, 不转发
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// 解密后协商了h2的连接由net/http处理, martian只支持HTTP/1.x
+func (p *ProxyEntity) newHTTP2Server() *http.Server {
+	return &http.Server{
+		Handler: http.HandlerFunc(p.serveHTTP2),
+	}
+}
+
+// 处理h2的请求, 与martian一样经过ModifyRequest和ModifyResponse
+func (p *ProxyEntity) serveHTTP2(w http.ResponseWriter, req *http.Request) {
+	if req.Method == "CONNECT" {
+		http.Error(w, "CONNECT is not supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// ModifyRequest和ModifyResponse通过req.Context()中的状态关联同一个请求
+	req, ctx := withRequestState(req)
+
+	req.URL.Scheme = "https"
+	req.URL.Host = req.Host
+	req.RequestURI = ""
+	for _, k := range hopHeaders {
+		req.Header.Del(k)
+	}
+
+	if err := p.ModifyRequest(req); err != nil {
+		log.Printf("failed to modify the request: %s, error: %v", req.URL.String(), err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	var res *http.Response
+	var err error
+	if ctx.SkippingRoundTrip() {
+		res = proxyutil.NewResponse(http.StatusOK, nil, req)
+	} else {
+		res, err = p.http2Transport.RoundTrip(req)
+		if err != nil {
+			log.Printf("failed to round trip: %s, error: %v", req.URL.String(), err)
+			res = proxyutil.NewResponse(http.StatusBadGateway, nil, req)
+			proxyutil.Warning(res.Header, err)
+		}
+	}
+	defer res.Body.Close()
+
+	if err := p.ModifyResponse(res); err != nil {
+		log.Printf("failed to modify the response: %s, error: %v", req.URL.String(), err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	writeHTTP2Response(w, res)
+}
+
+// 写入响应, 每次读取后立即发送, 支持gRPC等流式响应和trailer
+func writeHTTP2Response(w http.ResponseWriter, res *http.Response) {
+	header := w.Header()
+	for k, v := range res.Header {
+		header[k] = v
+	}
+	for _, k := range hopHeaders {
+		header.Del(k)
+	}
+	// 上游的Connection中列出的也是逐跳的请求头
+	for _, v := range res.Header["Connection"] {
+		for _, k := range strings.Split(v, ",") {
+			header.Del(strings.TrimSpace(k))
+		}
+	}
+
+	trailers := make([]string, 0, len(res.Trailer))
+	for k := range res.Trailer {
+		trailers = append(trailers, k)
+	}
+	if len(trailers) > 0 {
+		header.Set("Trailer", strings.Join(trailers, ", "))
+	}
+
+	w.WriteHeader(res.StatusCode)
+
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := res.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	for k, v := range res.Trailer {
+		header[k] = v
+	}
+}
@@ -0,0 +1,89 @@
+package goproxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+var errListenerClosed = errors.New("listener closed")
+
+// 把接管的连接交给martian处理的监听器, 通过Push放入连接
+type connListener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		addr:   addr,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (p *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-p.conns:
+		return conn, nil
+	case <-p.closed:
+		return nil, errListenerClosed
+	}
+}
+
+func (p *connListener) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+
+	return nil
+}
+
+func (p *connListener) Addr() net.Addr {
+	return p.addr
+}
+
+func (p *connListener) Push(conn net.Conn) error {
+	select {
+	case p.conns <- conn:
+		return nil
+	case <-p.closed:
+		return errListenerClosed
+	}
+}
+
+// 关闭时通知, 用于等待martian处理完连接
+type notifyConn struct {
+	net.Conn
+	done chan struct{}
+	once sync.Once
+}
+
+func newNotifyConn(conn net.Conn) *notifyConn {
+	return &notifyConn{
+		Conn: conn,
+		done: make(chan struct{}),
+	}
+}
+
+func (p *notifyConn) Close() error {
+	err := p.Conn.Close()
+	p.once.Do(func() {
+		close(p.done)
+	})
+
+	return err
+}
+
+// 读取时先返回已经预读的数据
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (p *peekedConn) Read(b []byte) (int, error) {
+	return p.r.Read(b)
+}
@@ -0,0 +1,273 @@
+package goproxy
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"mitmgo/src/core"
+	"mitmgo/src/core/common"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// martian上下文中标记访问内置页面的key
+const magicContextKey = "mitmgo.magic"
+
+// 默认的内置域名
+const DefaultMagicHost = "mitmgo.local"
+
+// 内置页面的响应
+type magicResponse struct {
+	statusCode  int
+	contentType string
+	headers     map[string]string
+	body        []byte
+}
+
+// 代理的运行状态
+type ProxyStatus struct {
+	Id               string           `json:"id"`
+	BeginRunTime     string           `json:"beginRunTime"`
+	MaxRunTime       int              `json:"maxRunTime"`       // 分钟
+	RemainingSeconds int64            `json:"remainingSeconds"` // 剩余运行时间, 没有限制时为-1
+	IsContainHttps   bool             `json:"isContainHttps"`
+	ResultCount      int              `json:"resultCount"`
+	HarCount         int              `json:"harCount"`
+	Filtered         map[string]int64 `json:"filtered"`
+	CASHA256         string           `json:"caSha256,omitempty"`
+}
+
+func (p *ProxyEntity) isMagicRequest(req *http.Request) bool {
+	if len(p.MagicHost) == 0 {
+		return false
+	}
+
+	host := req.URL.Host
+	if len(host) == 0 {
+		host = req.Host
+	}
+
+	return strings.EqualFold(common.StripPort(host), p.MagicHost)
+}
+
+func (p *ProxyEntity) Status() ProxyStatus {
+	status := ProxyStatus{
+		Id:               p.Id,
+		BeginRunTime:     p.BeginRunTime.Format("2006-01-02 15:04:05"),
+		MaxRunTime:       p.MaxRunTime,
+		RemainingSeconds: -1,
+		IsContainHttps:   p.issuer != nil,
+		ResultCount:      p.ResultSet.Count(),
+		Filtered:         p.FilterStats(),
+	}
+
+	if p.MaxRunTime >= 1 {
+		remaining := time.Until(p.BeginRunTime.Add(time.Duration(p.MaxRunTime) * time.Minute))
+		if remaining < 0 {
+			remaining = 0
+		}
+		status.RemainingSeconds = int64(remaining.Seconds())
+	}
+	if p.har != nil {
+		status.HarCount = p.har.Count()
+	}
+	if p.issuer != nil {
+		status.CASHA256 = core.FingerprintSHA256(p.issuer.Root())
+	}
+
+	return status
+}
+
+func formatRemaining(seconds int64) string {
+	if seconds < 0 {
+		return "不限制"
+	}
+
+	return (time.Duration(seconds) * time.Second).String()
+}
+
+// 内置页面, 提供CA下载、信任检测和运行状态
+func (p *ProxyEntity) serveMagic(req *http.Request) *magicResponse {
+	urlPath := req.URL.Path
+	switch urlPath {
+	case "", "/":
+		return p.magicIndex()
+	case "/status.json":
+		return &magicResponse{
+			statusCode:  http.StatusOK,
+			contentType: "application/json; charset=utf-8",
+			body:        []byte(common.ToJsonEncodeStruct(p.Status())),
+		}
+	case "/trust":
+		return p.magicTrust(req)
+	case "/trust.js":
+		// 只有客户端信任CA时才能通过https加载
+		return &magicResponse{
+			statusCode:  http.StatusOK,
+			contentType: "application/javascript",
+			headers: map[string]string{
+				"Cache-Control": "no-store",
+			},
+			body: []byte("window.mitmgoTrusted = true;"),
+		}
+	}
+
+	if p.issuer != nil {
+		ca := p.issuer.Root()
+		for _, format := range core.CAExportFormats {
+			name := core.CAExportFileName(ca, format.Format)
+			if urlPath != "/"+name {
+				continue
+			}
+
+			content, err := core.ExportCA(ca, format.Format, "")
+			if err != nil {
+				return magicError(http.StatusInternalServerError, err.Error())
+			}
+			return &magicResponse{
+				statusCode:  http.StatusOK,
+				contentType: format.ContentType,
+				headers: map[string]string{
+					"Content-Disposition": `attachment; filename="` + name + `"`,
+				},
+				body: content,
+			}
+		}
+	}
+
+	return magicError(http.StatusNotFound, "not found")
+}
+
+func magicError(statusCode int, message string) *magicResponse {
+	return &magicResponse{
+		statusCode:  statusCode,
+		contentType: "text/plain; charset=utf-8",
+		body:        []byte(message),
+	}
+}
+
+func magicPage(title string, content string) *magicResponse {
+	return &magicResponse{
+		statusCode:  http.StatusOK,
+		contentType: "text/html; charset=utf-8",
+		headers: map[string]string{
+			"Cache-Control": "no-store",
+		},
+		body: []byte(`<!DOCTYPE html>
+<html>
+<head>
+<meta http-equiv="Content-Type" content="text/html; charset=utf-8"/>
+<meta name="viewport" content="width=device-width, initial-scale=1"/>
+<title>` + html.EscapeString(title) + `</title>
+</head>
+<body>
+` + content + `
+</body>
+</html>
+`),
+	}
+}
+
+func (p *ProxyEntity) magicIndex() *magicResponse {
+	status := p.Status()
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "<h1>mitmgo</h1>\n<table>\n")
+	fmt.Fprintf(buf, "<tr><td>任务ID</td><td>%s</td></tr>\n", html.EscapeString(status.Id))
+	fmt.Fprintf(buf, "<tr><td>开始时间</td><td>%s</td></tr>\n", status.BeginRunTime)
+	fmt.Fprintf(buf, "<tr><td>剩余时间</td><td>%s</td></tr>\n", formatRemaining(status.RemainingSeconds))
+	fmt.Fprintf(buf, "<tr><td>结果数</td><td>%d</td></tr>\n", status.ResultCount)
+	if p.har != nil {
+		fmt.Fprintf(buf, "<tr><td>HAR记录数</td><td>%d</td></tr>\n", status.HarCount)
+	}
+	reasons := make([]string, 0, len(status.Filtered))
+	for reason := range status.Filtered {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(buf, "<tr><td>过滤(%s)</td><td>%d</td></tr>\n", html.EscapeString(reason), status.Filtered[reason])
+	}
+	fmt.Fprintf(buf, "</table>\n")
+
+	if p.issuer != nil {
+		ca := p.issuer.Root()
+		fmt.Fprintf(buf, "<h2>CA证书</h2>\n<p>%s</p>\n", html.EscapeString(ca.Subject.String()))
+		fmt.Fprintf(buf, "<p>SHA-1: %s<br/>SHA-256: %s</p>\n<ul>\n", core.FingerprintSHA1(ca), core.FingerprintSHA256(ca))
+		for _, format := range core.CAExportFormats {
+			name := core.CAExportFileName(ca, format.Format)
+			fmt.Fprintf(buf, "<li><a href=\"/%s\">%s</a> - %s</li>\n", name, name, html.EscapeString(format.Description))
+		}
+		fmt.Fprintf(buf, "</ul>\n<p><a href=\"/trust\">检测是否信任CA</a></p>\n")
+	} else {
+		fmt.Fprintf(buf, "<p>没有开启https, 不需要安装CA证书</p>\n")
+	}
+	fmt.Fprintf(buf, "<p><a href=\"/status.json\">status.json</a></p>\n")
+
+	return magicPage("mitmgo", buf.String())
+}
+
+// 通过https加载脚本判断客户端是否信任CA
+func (p *ProxyEntity) magicTrust(req *http.Request) *magicResponse {
+	if p.issuer == nil {
+		return magicPage("mitmgo", "<p>没有开启https, 不需要安装CA证书</p>")
+	}
+
+	// 当前请求已经是解密后的https请求, 说明客户端信任CA
+	if req.TLS != nil || req.URL.Scheme == "https" {
+		return magicPage("mitmgo", `<h1 style="color:green">已信任CA证书</h1><p><a href="/">返回</a></p>`)
+	}
+
+	script := "https://" + p.MagicHost + "/trust.js?t=" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	return magicPage("mitmgo", `<h1 id="result">正在检测...</h1>
+<p><a href="/">返回</a></p>
+<script>
+function showResult() {
+	var result = document.getElementById("result");
+	if (window.mitmgoTrusted) {
+		result.innerText = "已信任CA证书";
+		result.style.color = "green";
+	} else {
+		result.innerText = "没有信任CA证书";
+		result.style.color = "red";
+	}
+}
+</script>
+<script src="`+script+`" onload="showResult()" onerror="showResult()"></script>`)
+}
+
+// 在跳过转发的响应中写入内置页面
+func (p *ProxyEntity) writeMagicResponse(ctx requestContext, res *http.Response) bool {
+	if ctx == nil {
+		return false
+	}
+	v, ok := ctx.Get(magicContextKey)
+	if !ok {
+		return false
+	}
+	magic, ok := v.(*magicResponse)
+	if !ok || magic == nil {
+		return false
+	}
+
+	if res.Body != nil {
+		res.Body.Close()
+	}
+
+	res.StatusCode = magic.statusCode
+	res.Status = strconv.Itoa(magic.statusCode) + " " + http.StatusText(magic.statusCode)
+	res.Header = make(http.Header)
+	res.Header.Set("Content-Type", magic.contentType)
+	res.Header.Set("Content-Length", strconv.Itoa(len(magic.body)))
+	for k, v := range magic.headers {
+		res.Header.Set(k, v)
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(magic.body))
+	res.ContentLength = int64(len(magic.body))
+
+	return true
+}
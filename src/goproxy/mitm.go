@@ -0,0 +1,168 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"github.com/google/martian/v3"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// 接管CONNECT连接, TLS连接使用签发的证书解密, 解密后的连接交给martian处理
+// 需要同步处理, ModifyRequest返回后martian会关闭连接
+func (p *ProxyEntity) interceptConnect(ctx *martian.Context, req *http.Request) {
+	conn, brw, err := ctx.Session().Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	if _, err := brw.WriteString("HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+	if err := brw.Flush(); err != nil {
+		return
+	}
+
+	p.interceptConn(conn, brw.Reader, req.URL.Host)
+}
+
+// 是否为HTTP请求的开头
+func isHTTPRequest(b []byte) bool {
+	for _, method := range []string{"GET ", "POST ", "PUT ", "HEAD ", "DELETE ", "OPTIONS ", "PATCH ", "TRACE ", "CONNECT "} {
+		n := len(b)
+		if n > len(method) {
+			n = len(method)
+		}
+		if string(b[:n]) == method[:n] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// 处理客户端到target的连接, 通过首个字节判断协议
+// TLS连接在开启https时解密, HTTP请求交给martian处理, 其他协议直接转发
+// 调用者负责关闭conn, br为conn上已经读取了部分数据的缓冲区
+func (p *ProxyEntity) interceptConn(conn net.Conn, br *bufio.Reader, target string) {
+	conn.SetDeadline(time.Now().Add(p.TLSHandShakeTimeout))
+
+	b, err := br.Peek(1)
+	if err != nil {
+		// 服务端先发送数据的协议, 例如SSH
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			conn.SetDeadline(time.Time{})
+			p.tunnel(conn, br, target)
+		}
+		return
+	}
+
+	// 22 是TLS握手, https://tools.ietf.org/html/rfc5246#section-6.2.1
+	isTLS := b[0] == 22
+	if isTLS && p.issuer == nil {
+		conn.SetDeadline(time.Time{})
+		p.tunnel(conn, br, target)
+		return
+	}
+	if !isTLS {
+		b, _ = br.Peek(br.Buffered())
+		if !isHTTPRequest(b) {
+			conn.SetDeadline(time.Time{})
+			p.tunnel(conn, br, target)
+			return
+		}
+	}
+
+	var raw []byte
+	var hello *clientHello
+	var helloErr error
+	if isTLS {
+		raw, hello, helloErr = readClientHello(br)
+		if helloErr != nil && !errors.Is(helloErr, errInvalidClientHello) {
+			log.Printf("failed to read the client hello, host: %s, error: %v", target, helloErr)
+			return
+		}
+	}
+
+	// 已经读到缓冲区中的数据需要重新读取
+	buffered := make([]byte, br.Buffered())
+	br.Read(buffered)
+	reader := io.MultiReader(bytes.NewReader(raw), bytes.NewReader(buffered), conn)
+
+	host := target
+	if hello != nil && len(hello.ServerName) > 0 {
+		host = hello.ServerName
+	}
+
+	// 无法解析的ClientHello不解密, 已读取的数据原样转发给服务端
+	if helloErr != nil {
+		log.Printf("failed to parse the client hello, host: %s, error: %v", target, helloErr)
+		conn.SetDeadline(time.Time{})
+		reason := p.passthroughReason(target, "")
+		if len(reason) == 0 {
+			reason = PassthroughReasonInvalidHello
+		}
+		p.handshakeFailed(target)
+		p.passthrough(conn, reader, target, nil, reason)
+		return
+	}
+
+	// 不解密的host直接转发原始数据
+	if isTLS {
+		if reason := p.passthroughReason(target, host); len(reason) > 0 {
+			conn.SetDeadline(time.Time{})
+			p.passthrough(conn, reader, target, hello, reason)
+			return
+		}
+	}
+
+	nc := newNotifyConn(&peekedConn{
+		Conn: conn,
+		r:    reader,
+	})
+
+	var inner net.Conn = nc
+	listener := p.innerListener
+	// martian通过 *tls.Conn 判断是否为https, 因此直接传入tls连接
+	if isTLS {
+		config := p.issuer.TLSConfig(target)
+		if p.http2Listener != nil {
+			config.NextProtos = []string{"h2", "http/1.1"}
+		}
+		tlsconn := tls.Server(nc, config)
+		if err := tlsconn.Handshake(); err != nil {
+			log.Printf("tls handshake with client failed, host: %s, error: %v", host, err)
+			p.handshakeFailed(host)
+			return
+		}
+		p.handshakeSucceeded(host)
+		inner = tlsconn
+
+		addr := tlsconn.RemoteAddr().String()
+		p.addClientHello(addr, hello)
+		defer p.removeClientHello(addr)
+
+		// 协商了h2的连接交给h2的服务端处理
+		if tlsconn.ConnectionState().NegotiatedProtocol == "h2" {
+			listener = p.http2Listener
+		}
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	if err := listener.Push(inner); err != nil {
+		return
+	}
+
+	// 等待处理完连接或者代理关闭
+	select {
+	case <-nc.done:
+	case <-listener.closed:
+	}
+}
@@ -0,0 +1,195 @@
+package goproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mitmgo/src/core"
+	"mitmgo/src/core/common"
+	"net"
+	"strings"
+	"time"
+)
+
+// 不解密的原因
+const (
+	PassthroughReasonRule = "rule"
+	PassthroughReasonAuto = "auto"
+	// 无法解析ClientHello
+	PassthroughReasonInvalidHello = "invalid_client_hello"
+)
+
+// 判断是否不解密, 同时匹配CONNECT的目标和SNI, 返回原因, 需要解密时返回空
+func (p *ProxyEntity) passthroughReason(connectHost string, sni string) string {
+	hosts := []string{strings.ToLower(common.StripPort(connectHost))}
+	if len(sni) > 0 {
+		hosts = append(hosts, strings.ToLower(common.StripPort(sni)))
+	}
+
+	for _, host := range hosts {
+		if common.MatchHostAny(p.PassthroughHosts, host) {
+			return PassthroughReasonRule
+		}
+	}
+
+	p.lock_passthrough.Lock()
+	defer p.lock_passthrough.Unlock()
+	for _, host := range hosts {
+		if _, ok := p.autoPassthrough[host]; ok {
+			return PassthroughReasonAuto
+		}
+	}
+
+	return ""
+}
+
+// 记录与客户端握手失败的次数, 连续失败达到 AutoPassthrough 次后不再解密该host
+func (p *ProxyEntity) handshakeFailed(host string) {
+	if p.AutoPassthrough <= 0 {
+		return
+	}
+	host = strings.ToLower(common.StripPort(host))
+
+	p.lock_passthrough.Lock()
+	defer p.lock_passthrough.Unlock()
+
+	p.handshakeFailures[host]++
+	if p.handshakeFailures[host] >= p.AutoPassthrough {
+		delete(p.handshakeFailures, host)
+		p.autoPassthrough[host] = struct{}{}
+		log.Printf("switched %s to passthrough after %d failed handshakes", host, p.AutoPassthrough)
+	}
+}
+
+func (p *ProxyEntity) handshakeSucceeded(host string) {
+	if p.AutoPassthrough <= 0 {
+		return
+	}
+	host = strings.ToLower(common.StripPort(host))
+
+	p.lock_passthrough.Lock()
+	defer p.lock_passthrough.Unlock()
+
+	delete(p.handshakeFailures, host)
+}
+
+// 自动切换为不解密的host
+func (p *ProxyEntity) AutoPassthroughHosts() []string {
+	p.lock_passthrough.Lock()
+	defer p.lock_passthrough.Unlock()
+
+	hosts := make([]string, 0, len(p.autoPassthrough))
+	for host := range p.autoPassthrough {
+		hosts = append(hosts, host)
+	}
+
+	return hosts
+}
+
+type countWriter struct {
+	w     io.Writer
+	count int64
+}
+
+func (p *countWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.count += int64(n)
+	return n, err
+}
+
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
+// 直接转发客户端和服务端之间的数据, 只记录元数据
+func (p *ProxyEntity) passthrough(conn net.Conn, reader io.Reader, target string, hello *clientHello, reason string) {
+	startTime := time.Now()
+	result := core.PassthroughResult{
+		Id:         p.Id,
+		Type:       "passthrough",
+		Host:       target,
+		Reason:     reason,
+		ClientAddr: conn.RemoteAddr().String(),
+		StartTime:  startTime.Format("2006-01-02 15:04:05"),
+	}
+	if hello != nil {
+		result.SNI = hello.ServerName
+		result.ALPN = hello.ALPN
+		result.JA3Hash = hello.JA3Hash()
+		result.JA4 = hello.JA4()
+	}
+
+	defer func() {
+		result.Duration = time.Since(startTime).Milliseconds()
+		p.outputPassthrough(result)
+	}()
+
+	upstream, err := p.dialUpstream(context.Background(), "tcp", target)
+	if err != nil {
+		result.Error = err.Error()
+		return
+	}
+	defer upstream.Close()
+
+	result.BytesSent, result.BytesReceived = p.relay(conn, reader, upstream)
+}
+
+// 不记录的直接转发, 用于没有开启https时的TLS连接和无法识别的协议
+func (p *ProxyEntity) tunnel(conn net.Conn, reader io.Reader, target string) {
+	upstream, err := p.dialUpstream(context.Background(), "tcp", target)
+	if err != nil {
+		log.Printf("failed to connect %s, error: %v", target, err)
+		return
+	}
+	defer upstream.Close()
+
+	p.relay(conn, reader, upstream)
+}
+
+// 在客户端和服务端之间双向复制数据, 返回双方发送的字节数
+func (p *ProxyEntity) relay(conn net.Conn, reader io.Reader, upstream net.Conn) (int64, int64) {
+	sent := &countWriter{w: upstream}
+	received := &countWriter{w: conn}
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(sent, reader)
+		closeWrite(upstream)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(received, upstream)
+		closeWrite(conn)
+		done <- struct{}{}
+	}()
+
+	// 代理关闭时断开连接
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-p.innerListener.closed:
+			conn.Close()
+			upstream.Close()
+			<-done
+		}
+	}
+
+	return sent.count, received.count
+}
+
+func (p *ProxyEntity) outputPassthrough(result core.PassthroughResult) {
+	resultStr := common.ToJsonEncodeStruct(result)
+	if len(p.RemoteOutputAddr) > 0 {
+		if p.deliverer != nil {
+			p.deliverer.PushPassthrough(result)
+		}
+	} else {
+		fmt.Print(resultStr + "\r\n")
+	}
+	// 保存到结果集中, 退出时写入日志
+	p.ResultSet.Push(resultStr)
+}
@@ -0,0 +1,209 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"mitmgo/src/core"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestProxyEntity() *ProxyEntity {
+	p := NewProxyEntity("test", "127.0.0.1", 0, nil, nil, nil, true, "", 5, 5, 5, 1, "", "")
+	p.innerListener = newConnListener(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	return p
+}
+
+func newTestIssuer(t *testing.T) *core.CertIssuer {
+	t.Helper()
+
+	certPEM, keyPEM, err := core.GenerateCA(core.NewCAOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	material, err := core.ParseCA(certPEM, keyPEM, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer, err := core.NewCertIssuer(material.Cert, material.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return issuer
+}
+
+// 一对已连接的TCP连接
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		client.Close()
+		t.Fatal(err)
+	}
+
+	return client, server
+}
+
+// 原样返回收到的数据的服务端
+func echoServer(t *testing.T) net.Listener {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return l
+}
+
+func TestPassthroughReason(t *testing.T) {
+	p := newTestProxyEntity()
+	p.PassthroughHosts = []string{"*.apple.com", "Pinned.Example.com"}
+	p.autoPassthrough["auto.example.com"] = struct{}{}
+
+	tests := []struct {
+		connectHost string
+		sni         string
+		reason      string
+	}{
+		{"www.apple.com:443", "", PassthroughReasonRule},
+		{"apple.com:443", "", PassthroughReasonRule},
+		{"10.0.0.1:443", "gateway.icloud.apple.com", PassthroughReasonRule},
+		{"PINNED.example.com:8443", "", PassthroughReasonRule},
+		{"pinned.example.com", "", PassthroughReasonRule},
+		{"other.example.com:443", "pinned.example.com", PassthroughReasonRule},
+		{"auto.example.com:443", "", PassthroughReasonAuto},
+		{"10.0.0.1:443", "AUTO.example.com", PassthroughReasonAuto},
+		{"www.example.com:443", "www.example.com", ""},
+		{"apple.com.evil.com:443", "", ""},
+		{"sub.pinned.example.com:443", "", ""},
+	}
+
+	for _, tt := range tests {
+		if reason := p.passthroughReason(tt.connectHost, tt.sni); reason != tt.reason {
+			t.Errorf("passthroughReason(%q, %q) = %q, want %q", tt.connectHost, tt.sni, reason, tt.reason)
+		}
+	}
+}
+
+func TestAutoPassthroughThreshold(t *testing.T) {
+	p := newTestProxyEntity()
+	p.AutoPassthrough = 3
+
+	// 成功的握手重置计数, 只统计连续的失败
+	p.handshakeFailed("flaky.example.com:443")
+	p.handshakeFailed("flaky.example.com:443")
+	p.handshakeSucceeded("FLAKY.example.com:443")
+	p.handshakeFailed("flaky.example.com:443")
+	p.handshakeFailed("flaky.example.com:443")
+	if reason := p.passthroughReason("flaky.example.com:443", ""); reason != "" {
+		t.Fatalf("switched to passthrough without %d consecutive failures", p.AutoPassthrough)
+	}
+
+	p.handshakeFailed("flaky.example.com:8443")
+	if reason := p.passthroughReason("flaky.example.com:443", ""); reason != PassthroughReasonAuto {
+		t.Fatalf("reason = %q after %d consecutive failures, want %q", reason, p.AutoPassthrough, PassthroughReasonAuto)
+	}
+	if hosts := p.AutoPassthroughHosts(); len(hosts) != 1 || hosts[0] != "flaky.example.com" {
+		t.Fatalf("auto passthrough hosts = %v", hosts)
+	}
+
+	// 其他host不受影响
+	if reason := p.passthroughReason("other.example.com:443", ""); reason != "" {
+		t.Fatalf("reason of another host = %q", reason)
+	}
+
+	// 关闭时不记录
+	disabled := newTestProxyEntity()
+	for i := 0; i < 10; i++ {
+		disabled.handshakeFailed("flaky.example.com")
+	}
+	if reason := disabled.passthroughReason("flaky.example.com", ""); reason != "" {
+		t.Fatalf("reason = %q with auto passthrough disabled", reason)
+	}
+}
+
+// 无法解析的ClientHello原样转发给服务端, 并计入握手失败
+func TestInterceptInvalidClientHello(t *testing.T) {
+	upstream := echoServer(t)
+	defer upstream.Close()
+
+	p := newTestProxyEntity()
+	p.issuer = newTestIssuer(t)
+	p.AutoPassthrough = 1
+	target := upstream.Addr().String()
+
+	// 握手类型为2(ServerHello), 不是ClientHello
+	invalid := []byte{22, 3, 1, 0, 4, 2, 0, 0, 0}
+	payload := append(append([]byte{}, invalid...), "after the hello"...)
+
+	client, server := tcpPair(t)
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer server.Close()
+		p.interceptConn(server, bufio.NewReader(server), target)
+	}()
+
+	if _, err := client.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	echoed := make([]byte, len(payload))
+	if _, err := io.ReadFull(client, echoed); err != nil {
+		t.Fatalf("the connection is not forwarded: %v", err)
+	}
+	if !bytes.Equal(echoed, payload) {
+		t.Fatalf("forwarded %q, want %q", echoed, payload)
+	}
+	client.Close()
+	<-done
+
+	resultStr, ok := p.ResultSet.Pop().(string)
+	if !ok {
+		t.Fatal("the passthrough result is not recorded")
+	}
+	var result core.PassthroughResult
+	if err := json.Unmarshal([]byte(resultStr), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Reason != PassthroughReasonInvalidHello || result.Host != target {
+		t.Fatalf("result = %+v", result)
+	}
+	if result.BytesSent != int64(len(payload)) {
+		t.Fatalf("bytes sent = %d, want %d", result.BytesSent, len(payload))
+	}
+
+	// 达到阈值后切换为自动不解密
+	if reason := p.passthroughReason(target, ""); reason != PassthroughReasonAuto {
+		t.Fatalf("reason = %q after the failed handshake, want %q", reason, PassthroughReasonAuto)
+	}
+}
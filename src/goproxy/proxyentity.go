@@ -3,14 +3,13 @@ package goproxy
 import (
 	"bytes"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"github.com/google/martian/v3"
 	"github.com/google/martian/v3/auth"
 	mlog "github.com/google/martian/v3/log"
-	"github.com/google/martian/v3/mitm"
+	"io"
 	"io/ioutil"
 	"log"
 	"math"
@@ -24,6 +23,9 @@ import (
 	"time"
 )
 
+// martian上下文中保存当前请求结果的key
+const flowContextKey = "mitmgo.flow"
+
 var mediaType = map[string]struct{}{
 	"gif":   struct{}{},
 	"png":   struct{}{},
@@ -60,22 +62,88 @@ type ProxyEntity struct {
 	IP                  string // ip
 	Port                uint16 //  端口
 	Headers             map[string]string
+	HeaderRules         []core.HeaderRule // 请求头改写规则, 在Headers之后应用
 	Hosts               []string
 	IgnoreWords         []string
-	IsContainHttps      bool          // 是否包含https请求
-	RemoteOutputAddr    string        // 远程输出地址
-	Timeout             time.Duration // 连接超时时间
-	KeepAlive           time.Duration // 保持连接时间
-	TLSHandShakeTimeout time.Duration // 握手超时时间
-	MaxRunTime          int           // 最大运行时间
-	BeginRunTime        time.Time     // 开始运行时间
-	IsExpireTip         bool          // 是否到期提醒
-	ResultSet           *common.Stack // 保存结果，只保存生成的JSON字符串
+	Scope               *core.ScopeConfig         // 范围规则, 与Hosts和IgnoreWords合并
+	Methods             []string                  // 允许记录的请求方法, 为空表示全部
+	IsContainHttps      bool                      // 是否包含https请求
+	RemoteOutputAddr    string                    // 远程输出地址
+	Timeout             time.Duration             // 连接超时时间
+	KeepAlive           time.Duration             // 保持连接时间
+	TLSHandShakeTimeout time.Duration             // 握手超时时间
+	MaxRunTime          int                       // 最大运行时间
+	BeginRunTime        time.Time                 // 开始运行时间
+	IsExpireTip         bool                      // 是否到期提醒
+	ResultSet           *common.Stack             // 保存结果，只保存生成的JSON字符串
+	IsCaptureBody       bool                      // 是否保存响应体
+	MaxBodySize         int                       // 保存响应体的最大长度
+	BatchSize           int                       // 每次发送到远程地址的结果数
+	FlushInterval       time.Duration             // 发送不足一批结果的间隔
+	MaxRetries          int                       // 发送失败的重试次数
+	QueueSize           int                       // 发送队列长度
+	SpoolDir            string                    // 远程地址不可用时保存结果的目录
+	IsRecordHAR         bool                      // 是否以HAR格式记录会话
+	HarMaxEntries       int                       // HAR最多保存的记录数, 超过时丢弃最早的记录
+	HarMaxBytes         int64                     // HAR最多占用的内存
+	Version             string                    // 程序版本, 写入HAR
+	IsKeepStatic        bool                      // 是否保留静态资源
+	StaticExtensions    []string                  // 自定义的静态资源扩展名
+	StaticContentTypes  []string                  // 自定义的静态资源Content-Type
+	MagicHost           string                    // 内置页面的域名, 为空表示关闭
+	PassthroughHosts    []string                  // 不解密的host, 匹配CONNECT的目标或者SNI
+	AutoPassthrough     int                       // 与客户端连续握手失败多少次后不再解密, 0表示关闭
+	CAChain             string                    // 中间证书文件
+	CAPassword          string                    // PKCS#12或者加密私钥的密码
+	LeafValidity        time.Duration             // 叶子证书有效期
+	LeafKeyType         string                    // 叶子证书私钥类型
+	CertCacheSize       int                       // 内存中缓存的叶子证书数
+	CertCacheDir        string                    // 叶子证书的磁盘缓存目录
+	LeafMimic           bool                      // 按上游服务器的证书仿造叶子证书
+	SocksPort           uint16                    // SOCKS5的端口, 0表示不开启
+	SocksUser           string                    // SOCKS5的用户名, 为空表示不认证
+	SocksPassword       string                    // SOCKS5的密码
+	TransparentPort     uint16                    // 透明代理的端口, 接收iptables/nftables重定向的连接, 只支持linux
+	ReverseUpstream     string                    // 反向代理的上游地址, 为空表示不开启, 例如 https://staging.example.com/api
+	ReversePort         uint16                    // 反向代理的端口
+	ReverseHTTPS        bool                      // 反向代理使用https, 证书由CA签发
+	UpstreamTLS         []core.UpstreamTLSProfile // 连接上游服务器的TLS配置, 按host匹配
+	UpstreamInsecure    bool                      // 不验证没有匹配任何配置的上游服务器证书
+	UpstreamProxyRules  []core.UpstreamProxyRule  // 上游代理规则, 按host匹配
+	DisableHTTP2        bool                      // 解密的连接不协商h2
 	proxy               *martian.Proxy
 	ca                  string
 	prikey              string
+	headerRuleSet       *core.HeaderRuleSet
+	scope               *core.Scope
+	deliverer           *core.Deliverer
+	har                 *core.HarRecorder
+	issuer              *core.CertIssuer
+	upstreamTLS         *core.UpstreamTLS
+	upstreamProxies     *core.UpstreamProxies
+	innerListener       *connListener // 解密后的连接
+	http2Listener       *connListener // 解密后协商了h2的连接
+	http2Server         *http.Server
+	http2Transport      *http.Transport
+	socksListener       net.Listener
+	transparentListener net.Listener
+	reverseProxy        *martian.Proxy
+	reverseListener     net.Listener
+	handshakeFailures   map[string]int
+	autoPassthrough     map[string]struct{}
+	lock_passthrough    sync.Mutex
+	serverCerts         map[string]string // 已经记录的上游证书, host对应证书指纹
+	lock_serverCerts    sync.Mutex
+	clientHellos        map[string]*core.ClientTLSInfo // 解密连接的客户端TLS信息, key为客户端地址
+	lock_clientHellos   sync.Mutex
+	proxyFailures       map[string]time.Time // 上游代理最近一次连接失败的时间
+	lock_proxyFailures  sync.Mutex
 	resultHash          map[string]struct{} // 保存结果hash
 	lock_resultHash     sync.Mutex
+	staticExtensions    map[string]struct{}
+	staticContentTypes  []string
+	filterStats         map[string]int64 // 按原因统计被过滤的数量
+	lock_filterStats    sync.Mutex
 }
 
 func NewProxyEntity(Id string,
@@ -126,10 +194,19 @@ func NewProxyEntity(Id string,
 		RemoteOutputAddr:    remoteOutputAddr,
 		MaxRunTime:          maxruntime,
 		ResultSet:           common.NewStack(),
+		MaxBodySize:         64 * 1024,
+		MaxRetries:          5,
+		MagicHost:           DefaultMagicHost,
 		ca:                  ca,
 		prikey:              prikey,
 		proxy:               martian.NewProxy(),
 		resultHash:          make(map[string]struct{}),
+		filterStats:         make(map[string]int64),
+		handshakeFailures:   make(map[string]int),
+		autoPassthrough:     make(map[string]struct{}),
+		serverCerts:         make(map[string]string),
+		clientHellos:        make(map[string]*core.ClientTLSInfo),
+		proxyFailures:       make(map[string]time.Time),
 	}
 
 	for k, v := range headers {
@@ -150,43 +227,162 @@ func (p *ProxyEntity) StartServer() error {
 		return err
 	}
 
+	// --headers 转换为set规则, 只对 --hosts 生效, 优先于自定义规则应用
+	rules := core.HeadersToRules(p.Headers, p.Hosts)
+	rules = append(rules, p.HeaderRules...)
+	p.headerRuleSet, err = core.NewHeaderRuleSet(rules)
+	if err != nil {
+		l.Close()
+		return err
+	}
+
+	scopeConfig := core.ScopeConfigFromFlags(p.Hosts, p.IgnoreWords)
+	scopeConfig.Merge(p.Scope)
+	p.scope, err = core.NewScope(scopeConfig)
+	if err != nil {
+		l.Close()
+		return err
+	}
+
+	p.initStaticFilter()
+
+	// 没有匹配任何配置的上游服务器使用系统根证书验证
+	p.upstreamTLS, err = core.NewUpstreamTLS(p.UpstreamTLS, &tls.Config{
+		InsecureSkipVerify: p.UpstreamInsecure,
+	})
+	if err != nil {
+		l.Close()
+		return err
+	}
+
+	p.upstreamProxies, err = core.NewUpstreamProxies(p.UpstreamProxyRules)
+	if err != nil {
+		l.Close()
+		return err
+	}
+
+	if p.IsRecordHAR {
+		p.har = core.NewHarRecorder(p.Version)
+		if p.HarMaxEntries > 0 {
+			p.har.MaxEntries = p.HarMaxEntries
+		}
+		if p.HarMaxBytes > 0 {
+			p.har.MaxBytes = p.HarMaxBytes
+		}
+	}
+
+	if len(p.RemoteOutputAddr) > 0 {
+		p.deliverer = core.NewDeliverer(p.Id,
+			p.RemoteOutputAddr,
+			p.BatchSize,
+			p.FlushInterval,
+			p.MaxRetries,
+			p.QueueSize,
+			p.SpoolDir)
+		err = p.deliverer.Start()
+		if err != nil {
+			l.Close()
+			return err
+		}
+	}
+
 	p.BeginRunTime = time.Now()
 	tr := &http.Transport{
-		Dial: (&net.Dialer{
-			Timeout:   p.Timeout,
-			KeepAlive: p.KeepAlive,
-		}).Dial,
+		DialTLSContext:        p.dialTLS,
 		TLSHandshakeTimeout:   p.TLSHandShakeTimeout,
 		ExpectContinueTimeout: 20 * time.Second,
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: false,
-		},
 	}
 
+	// SetRoundTripper会替换tr.Dial, 需要在之后设置
 	p.proxy.SetRoundTripper(tr)
+	p.proxy.SetDial(p.dial)
 
 	if p.IsContainHttps {
-		var x509c *x509.Certificate
-		var priv interface{}
+		material, err := core.LoadCA(p.ca, p.prikey, p.CAChain, p.CAPassword)
+		if err != nil {
+			p.closeOnStartFailed(l)
+			return err
+		}
 
-		tlsc, err := tls.LoadX509KeyPair(p.ca, p.prikey)
+		p.issuer, err = core.NewCertIssuer(material.Cert, material.Key)
 		if err != nil {
-			log.Fatal(err)
+			p.closeOnStartFailed(l)
+			return err
+		}
+		if p.LeafValidity > 0 {
+			p.issuer.Validity = p.LeafValidity
+		}
+		if len(p.LeafKeyType) > 0 {
+			p.issuer.KeyType = p.LeafKeyType
+		}
+		if p.CertCacheSize > 0 {
+			p.issuer.CacheSize = p.CertCacheSize
+		}
+		p.issuer.CacheDir = p.CertCacheDir
+		p.issuer.Chain = material.Chain
+		if p.LeafMimic {
+			p.issuer.Upstream = p.upstreamCertificate
+		}
+		if len(material.Chain) > 0 {
+			log.Printf("signing with the intermediate ca: %s, root: %s", material.Cert.Subject.String(), p.issuer.Root().Subject.String())
+		}
+
+		// 检查私钥类型是否可用
+		if !core.IsValidKeyType(p.issuer.KeyType) {
+			p.closeOnStartFailed(l)
+			return errors.New("unsupported leaf key type: " + p.issuer.KeyType)
+		}
+
+	}
+
+	if p.TransparentPort > 0 && !transparentSupported {
+		p.closeOnStartFailed(l)
+		return errors.New("the transparent mode is only supported on linux")
+	}
+
+	// 解密后的连接以及SOCKS5和透明代理中的HTTP请求交给martian处理
+	if p.issuer != nil || p.SocksPort > 0 || p.TransparentPort > 0 {
+		p.innerListener = newConnListener(l.Addr())
+		go p.proxy.Serve(p.innerListener)
+	}
+
+	if p.issuer != nil && !p.DisableHTTP2 {
+		p.http2Transport = &http.Transport{
+			DialContext:           p.dialUpstream,
+			DialTLSContext:        p.dialTLSHTTP2,
+			ForceAttemptHTTP2:     true,
+			TLSHandshakeTimeout:   p.TLSHandShakeTimeout,
+			ExpectContinueTimeout: 20 * time.Second,
 		}
-		priv = tlsc.PrivateKey
+		p.http2Listener = newConnListener(l.Addr())
+		p.http2Server = p.newHTTP2Server()
+		go p.http2Server.Serve(p.http2Listener)
+	}
 
-		x509c, err = x509.ParseCertificate(tlsc.Certificate[0])
+	if p.SocksPort > 0 {
+		p.socksListener, err = net.Listen("tcp", p.IP+":"+strconv.Itoa(int(p.SocksPort)))
 		if err != nil {
-			log.Fatal(err)
+			p.closeOnStartFailed(l)
+			return err
 		}
+		log.Printf("starting socks5 proxy on %s ", p.socksListener.Addr().String())
+		go p.serveSocks(p.socksListener)
+	}
 
-		if x509c != nil && priv != nil {
-			mc, err := mitm.NewConfig(x509c, priv)
-			if err != nil {
-				log.Fatal(err)
-			}
+	if p.TransparentPort > 0 {
+		p.transparentListener, err = net.Listen("tcp", p.IP+":"+strconv.Itoa(int(p.TransparentPort)))
+		if err != nil {
+			p.closeOnStartFailed(l)
+			return err
+		}
+		log.Printf("starting transparent proxy on %s ", p.transparentListener.Addr().String())
+		go p.serveTransparent(p.transparentListener)
+	}
 
-			p.proxy.SetMITM(mc)
+	if len(p.ReverseUpstream) > 0 {
+		if err := p.startReverse(tr); err != nil {
+			p.closeOnStartFailed(l)
+			return err
 		}
 	}
 	// add modifier
@@ -213,39 +409,94 @@ func (p *ProxyEntity) StartServer() error {
 	return nil
 }
 
+func (p *ProxyEntity) closeOnStartFailed(l net.Listener) {
+	l.Close()
+	p.closeListeners()
+	if p.deliverer != nil {
+		p.deliverer.Close()
+	}
+}
+
+// 签发叶子证书的issuer, 没有开启https时为nil
+func (p *ProxyEntity) Issuer() *core.CertIssuer {
+	return p.issuer
+}
+
+// 关闭除了HTTP代理之外的监听
+func (p *ProxyEntity) closeListeners() {
+	if p.reverseProxy != nil {
+		p.reverseProxy.Close()
+		p.reverseListener.Close()
+	}
+	if p.socksListener != nil {
+		p.socksListener.Close()
+	}
+	if p.transparentListener != nil {
+		p.transparentListener.Close()
+	}
+	if p.innerListener != nil {
+		p.innerListener.Close()
+	}
+	if p.http2Server != nil {
+		p.http2Server.Close()
+		p.http2Transport.CloseIdleConnections()
+	}
+}
+
 func (p *ProxyEntity) Close() {
+	p.closeListeners()
 	p.proxy.Close()
+
+	// 发送剩余的结果
+	if p.deliverer != nil {
+		p.deliverer.Close()
+	}
 }
 
 func (p *ProxyEntity) ModifyRequest(req *http.Request) error {
 
-	ctx := martian.NewContext(req)
-	actx := auth.FromContext(ctx)
+	ctx := contextOf(req)
+	if ctx == nil {
+		return nil
+	}
+	if mctx, ok := ctx.(*martian.Context); ok {
+		actx := auth.FromContext(mctx)
+		actx.SetID(id(req.Header))
 
-	actx.SetID(id(req.Header))
+		// 开启https时自行解密, 为每个host签发证书
+		if req.Method == "CONNECT" && p.issuer != nil {
+			p.interceptConnect(mctx, req)
+			return nil
+		}
+	}
 
-	if req.Method == "GET" || req.Method == "POST" {
-		if len(p.Hosts) > 0 {
-			var bFind = false
-			for _, k := range p.Hosts {
-				if strings.Trim(strings.ToLower(req.URL.Host), " ") == strings.Trim(strings.ToLower(k), " ") {
-					bFind = true
-				}
-			}
+	// 内置页面由代理直接响应, 不转发也不记录
+	if req.Method != "CONNECT" && p.isMagicRequest(req) {
+		ctx.SkipRoundTrip()
+		ctx.Set(magicContextKey, p.serveMagic(req))
+		return nil
+	}
 
-			// 没有找到匹配
-			if !bFind {
-				return nil
-			}
+	// 转发前改写请求头, 结果集中记录的是改写后的请求头
+	if req.Method != "CONNECT" {
+		p.headerRuleSet.Apply(req)
+	}
+
+	if req.Method != "CONNECT" {
+		if !p.isAllowedMethod(req.Method) {
+			p.countFiltered(FilterReasonMethod)
+			return nil
 		}
-		if len(p.IgnoreWords) > 0 {
-			bFind := false
-			for _, word := range p.IgnoreWords {
-				bFind = strings.Contains(req.URL.String(), word)
-				if bFind {
-					return nil
-				}
-			}
+		// 不在范围内的请求不作为结果
+		if !p.scope.InScope(req) {
+			p.countFiltered(FilterReasonScope)
+			return nil
+		}
+
+		// 不协商压缩扩展, 消息可以直接记录
+		if isWebSocketUpgrade(req.Header) {
+			req.Header.Del("Sec-WebSocket-Extensions")
+			ctx.Set(webSocketContextKey, true)
 		}
 
 		func() error {
@@ -256,6 +507,25 @@ func (p *ProxyEntity) ModifyRequest(req *http.Request) error {
 			if crawlResult == nil {
 				return nil
 			}
+			crawlResult.TLS = p.clientTLSInfo(req)
+
+			f := &flow{
+				startTime: time.Now(),
+			}
+			// HAR记录全部请求, 不去重
+			if p.har != nil {
+				harRequest := core.NewHarRequest(req, []byte(crawlResult.PostData))
+				f.harRequest = &harRequest
+			}
+
+			// 静态资源不作为结果
+			if p.isStaticExtension(req.URL.Path) {
+				p.countFiltered(FilterReasonStaticExtension)
+				if f.harRequest != nil {
+					ctx.Set(flowContextKey, f)
+				}
+				return nil
+			}
 
 			// 去重
 			fret := func() error {
@@ -273,66 +543,163 @@ func (p *ProxyEntity) ModifyRequest(req *http.Request) error {
 				return nil
 			}()
 
-			if fret != nil {
-				return nil
+			if fret == nil {
+				crawlResult.FlowId = ctx.ID()
+				f.result = crawlResult
+			} else {
+				p.countFiltered(FilterReasonDuplicate)
 			}
 
-			if len(p.RemoteOutputAddr) > 0 {
-				remoteResult := core.NewRemoteOutputCrawlResult()
-				remoteResult.Id = p.Id
-				remoteResult.Result = append(remoteResult.Result, *crawlResult)
-				resultStr := common.ToJsonEncodeStruct(remoteResult)
+			// 等待响应后在ModifyResponse中输出
+			if f.result != nil || f.harRequest != nil {
+				ctx.Set(flowContextKey, f)
+			}
 
-				// send data to the remote addr
-				httpModule, err := common.NewHttpModule()
-				if err != nil {
-					log.Println(err)
-					return nil
-				}
+			return nil
 
-				httpRes, err := httpModule.POST(p.RemoteOutputAddr,
-					map[string]interface{}{
-						"Content-Type": "application/json",
-					}, resultStr)
+		}()
+	}
 
-				if err != nil {
-					fmt.Println("Post the results to the server: " + err.Error())
-				}
+	return nil
+}
 
-				if httpRes != nil && len(httpRes.Body) > 0 {
-					fmt.Println("Return message: " + httpRes.Body)
-				}
+func (p *ProxyEntity) isAllowedMethod(method string) bool {
+	if len(p.Methods) == 0 {
+		return true
+	}
 
-				httpModule.Release()
-				// 保存结果到结果集中
-				p.ResultSet.Push(resultStr)
-			} else {
-				printResultStr := common.ToJsonEncodeStruct(crawlResult)
-				fmt.Print(printResultStr + "\r\n")
-				// 保存结果到结果集中
-				p.ResultSet.Push(printResultStr)
+	for _, k := range p.Methods {
+		if strings.EqualFold(k, method) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// 输出结果: 发送到远程地址或者打印, 并保存到结果集中
+func (p *ProxyEntity) output(crawlResult *core.RequestResult) {
+	if len(p.RemoteOutputAddr) > 0 {
+		remoteResult := core.NewRemoteOutputCrawlResult()
+		remoteResult.Id = p.Id
+		remoteResult.Result = append(remoteResult.Result, *crawlResult)
+		resultStr := common.ToJsonEncodeStruct(remoteResult)
+
+		// 由后台队列批量发送, 不阻塞客户端的请求
+		if p.deliverer != nil {
+			p.deliverer.Push(*crawlResult)
+		}
+		// 保存结果到结果集中
+		p.ResultSet.Push(resultStr)
+	} else {
+		printResultStr := common.ToJsonEncodeStruct(crawlResult)
+		fmt.Print(printResultStr + "\r\n")
+		// 保存结果到结果集中
+		p.ResultSet.Push(printResultStr)
+	}
+}
+
+// 记录响应信息, 响应体转发完成后输出对应的结果
+func (p *ProxyEntity) captureResponse(ctx requestContext, res *http.Response) {
+	if ctx == nil {
+		return
+	}
+	v, ok := ctx.Get(flowContextKey)
+	if !ok {
+		return
+	}
+	f, ok := v.(*flow)
+	if !ok || f == nil {
+		return
+	}
+
+	f.headerTime = time.Now()
+	// 没有扩展名的静态资源按Content-Type过滤
+	if f.result != nil && p.isStaticContentType(res) {
+		p.countFiltered(FilterReasonStaticContentType)
+		// 丢弃的结果不占用去重的hash, 之后相同的请求仍然按Content-Type统计
+		p.lock_resultHash.Lock()
+		delete(p.resultHash, f.result.Hash)
+		p.lock_resultHash.Unlock()
+		f.result = nil
+	}
+	if f.result == nil && f.harRequest == nil {
+		return
+	}
+	if f.result != nil {
+		f.result.Response = core.NewResponseResult(res)
+	}
+
+	limit := 0
+	if p.IsCaptureBody || f.harRequest != nil {
+		limit = p.MaxBodySize
+	}
+
+	done := func(body *captureBody) {
+		if f.result != nil {
+			f.result.Response.BodyLength = body.length
+			f.result.Response.BodyHash = body.Sum()
+			if p.IsCaptureBody {
+				f.result.Response.SetBody(body.Bytes(), body.truncated, p.MaxBodySize)
 			}
+			p.output(f.result)
+		}
 
-			return nil
+		if f.harRequest != nil {
+			harResponse := core.NewHarResponse(res, body.Bytes(), body.length, body.truncated, p.MaxBodySize)
+			p.har.Add(core.NewHarEntry(f.startTime,
+				*f.harRequest,
+				harResponse,
+				f.headerTime.Sub(f.startTime),
+				time.Since(f.headerTime)))
+		}
+	}
 
-		}()
+	if res.Body == nil {
+		done(newCaptureBody(http.NoBody, 0, nil))
+		return
 	}
 
-	return nil
+	res.Body = newCaptureBody(res.Body, limit, done)
+}
+
+// 输出HAR格式的会话记录, 没有开启HAR时返回错误
+func (p *ProxyEntity) WriteHAR(w io.Writer) error {
+	if p.har == nil {
+		return errors.New("har recording is not enabled")
+	}
+
+	_, err := p.har.WriteTo(w)
+	return err
+}
+
+// 保存HAR文件
+func (p *ProxyEntity) SaveHAR(path string) error {
+	if p.har == nil {
+		return errors.New("har recording is not enabled")
+	}
+
+	return p.har.SaveFile(path)
 }
 
 func (p *ProxyEntity) ModifyResponse(res *http.Response) error {
-	ctx := martian.NewContext(res.Request)
-	actx := auth.FromContext(ctx)
-	if got, want := actx.ID(), "admin:admin"; got != want {
-		//res.StatusCode = http.StatusProxyAuthRequired
-		//res.Header.Set("Proxy-Authenticate", "Basic")
-		//res.Body =
-		//
-		//res.ContentLength = 0
-		//UpdateResponse(res)
+	ctx := contextOf(res.Request)
+	if mctx, ok := ctx.(*martian.Context); ok {
+		actx := auth.FromContext(mctx)
+		if got, want := actx.ID(), "admin:admin"; got != want {
+			//res.StatusCode = http.StatusProxyAuthRequired
+			//res.Header.Set("Proxy-Authenticate", "Basic")
+			//res.Body =
+			//
+			//res.ContentLength = 0
+			//UpdateResponse(res)
+
+			//return errors.New("sddd")
+		}
+	}
 
-		//return errors.New("sddd")
+	if p.writeMagicResponse(ctx, res) {
+		return nil
 	}
 
 	if p.MaxRunTime >= 1 {
@@ -374,6 +741,20 @@ func (p *ProxyEntity) ModifyResponse(res *http.Response) error {
 		}
 	}
 
+	// 握手成功后由代理转发WebSocket帧, 握手的结果不等待响应体直接输出
+	if res.StatusCode == http.StatusSwitchingProtocols && isWebSocketUpgrade(res.Header) {
+		body := res.Body
+		res.Body = nil
+		p.captureResponse(ctx, res)
+		res.Body = body
+		if mctx, ok := ctx.(*martian.Context); ok {
+			p.interceptWebSocket(mctx, res)
+		}
+		return nil
+	}
+
+	p.captureResponse(ctx, res)
+
 	return nil
 }
 
@@ -0,0 +1,290 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/google/martian/v3"
+	"log"
+	"mitmgo/src/core"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// martian上下文中保存客户端访问的地址的key
+const reverseContextKey = "mitmgo.reverse"
+
+// 客户端访问反向代理时使用的scheme和host
+type reverseFront struct {
+	scheme string
+	host   string
+}
+
+// 反向代理, 将全部请求转发到同一个上游地址, 请求和响应仍然由ProxyEntity记录
+type reverseModifier struct {
+	entity   *ProxyEntity
+	upstream *url.URL
+}
+
+func parseReverseUpstream(rawurl string) (*url.URL, error) {
+	upstream, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if upstream.Scheme != "http" && upstream.Scheme != "https" {
+		return nil, errors.New("the scheme of the reverse upstream must be http or https")
+	}
+	if len(upstream.Host) == 0 {
+		return nil, errors.New("the host of the reverse upstream is empty")
+	}
+	upstream.Path = strings.TrimSuffix(upstream.Path, "/")
+	upstream.RawPath = ""
+	upstream.RawQuery = ""
+	upstream.Fragment = ""
+
+	return upstream, nil
+}
+
+// 按SNI签发证书, 没有SNI时使用客户端连接的本机地址
+func reverseTLSConfig(issuer *core.CertIssuer) *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			host := hello.ServerName
+			if len(host) == 0 && hello.Conn != nil {
+				host, _, _ = net.SplitHostPort(hello.Conn.LocalAddr().String())
+			}
+
+			return issuer.Issue(host)
+		},
+		NextProtos: []string{"http/1.1"},
+	}
+}
+
+func (p *reverseModifier) ModifyRequest(req *http.Request) error {
+	ctx := martian.NewContext(req)
+
+	// 反向代理不支持CONNECT
+	if req.Method == "CONNECT" {
+		conn, _, err := ctx.Session().Hijack()
+		if err == nil {
+			conn.Write([]byte("HTTP/1.1 405 Method Not Allowed\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+			conn.Close()
+		}
+		return nil
+	}
+
+	front := &reverseFront{
+		scheme: "http",
+		host:   req.Host,
+	}
+	if req.TLS != nil {
+		front.scheme = "https"
+	}
+	ctx.Set(reverseContextKey, front)
+
+	req.URL.Scheme = p.upstream.Scheme
+	req.URL.Host = p.upstream.Host
+	req.URL.Path = p.upstream.Path + req.URL.Path
+	if len(req.URL.RawPath) > 0 {
+		req.URL.RawPath = p.upstream.EscapedPath() + req.URL.RawPath
+	}
+	req.Host = p.upstream.Host
+
+	return p.entity.ModifyRequest(req)
+}
+
+func (p *reverseModifier) ModifyResponse(res *http.Response) error {
+	err := p.entity.ModifyResponse(res)
+
+	if res.Request == nil {
+		return err
+	}
+	v, ok := martian.NewContext(res.Request).Get(reverseContextKey)
+	if !ok {
+		return err
+	}
+	front, ok := v.(*reverseFront)
+	if !ok {
+		return err
+	}
+
+	if location := res.Header.Get("Location"); len(location) > 0 {
+		res.Header.Set("Location", p.rewriteLocation(location, front))
+	}
+
+	if cookies := res.Header.Values("Set-Cookie"); len(cookies) > 0 {
+		res.Header.Del("Set-Cookie")
+		for _, cookie := range cookies {
+			res.Header.Add("Set-Cookie", p.rewriteCookie(cookie, front))
+		}
+	}
+
+	return err
+}
+
+// 去掉上游的路径前缀, path为转义后的路径
+func (p *reverseModifier) stripBasePath(path string) string {
+	base := p.upstream.EscapedPath()
+	if len(base) == 0 {
+		return path
+	}
+	if path == base {
+		return "/"
+	}
+	if strings.HasPrefix(path, base+"/") {
+		return path[len(base):]
+	}
+
+	return path
+}
+
+// 去掉url的路径前缀, 保留原有的转义
+func (p *reverseModifier) stripURLPath(u *url.URL) {
+	escaped := p.stripBasePath(u.EscapedPath())
+	if path, err := url.PathUnescape(escaped); err == nil {
+		u.Path = path
+		u.RawPath = escaped
+	}
+}
+
+// 地址是否指向上游, 没有端口时只比较主机名, 指定端口时按默认端口比较
+func (p *reverseModifier) isUpstream(u *url.URL) bool {
+	if !strings.EqualFold(u.Hostname(), p.upstream.Hostname()) {
+		return false
+	}
+	if len(u.Port()) == 0 {
+		return true
+	}
+
+	scheme := u.Scheme
+	if len(scheme) == 0 {
+		scheme = p.upstream.Scheme
+	}
+
+	return defaultPort(scheme, u.Port()) == defaultPort(p.upstream.Scheme, p.upstream.Port())
+}
+
+func defaultPort(scheme string, port string) string {
+	if len(port) > 0 {
+		return port
+	}
+	if strings.EqualFold(scheme, "https") {
+		return "443"
+	}
+
+	return "80"
+}
+
+// 指向上游的跳转地址改为反向代理的地址
+func (p *reverseModifier) rewriteLocation(location string, front *reverseFront) string {
+	u, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+
+	// 相对地址只需要去掉路径前缀
+	if len(u.Host) == 0 {
+		if len(u.Scheme) == 0 && strings.HasPrefix(u.Path, "/") {
+			p.stripURLPath(u)
+		}
+		return u.String()
+	}
+
+	if !p.isUpstream(u) {
+		return location
+	}
+
+	u.Scheme = front.scheme
+	u.Host = front.host
+	p.stripURLPath(u)
+
+	return u.String()
+}
+
+// 去掉与上游匹配的Domain, 使cookie属于反向代理的地址
+// 反向代理使用http时去掉Secure和依赖Secure的SameSite=None, 路径去掉上游的前缀
+func (p *reverseModifier) rewriteCookie(cookie string, front *reverseFront) string {
+	upstreamHost := strings.ToLower(p.upstream.Hostname())
+
+	parts := strings.Split(cookie, ";")
+	result := make([]string, 0, len(parts))
+	result = append(result, parts[0])
+	for _, part := range parts[1:] {
+		attr := strings.TrimSpace(part)
+		name := attr
+		value := ""
+		if i := strings.Index(attr, "="); i >= 0 {
+			name = strings.TrimSpace(attr[:i])
+			value = strings.TrimSpace(attr[i+1:])
+		}
+
+		switch strings.ToLower(name) {
+		case "domain":
+			domain := strings.ToLower(strings.TrimPrefix(value, "."))
+			if domain == upstreamHost || strings.HasSuffix(upstreamHost, "."+domain) {
+				continue
+			}
+		case "secure":
+			if front.scheme == "http" {
+				continue
+			}
+		case "samesite":
+			// 没有Secure时浏览器会拒绝SameSite=None
+			if front.scheme == "http" && strings.EqualFold(value, "none") {
+				continue
+			}
+		case "path":
+			if strings.HasPrefix(value, "/") {
+				part = " Path=" + p.stripBasePath(value)
+			}
+		}
+		result = append(result, part)
+	}
+
+	return strings.Join(result, ";")
+}
+
+// 开启反向代理, 与HTTP代理使用相同的上游连接
+func (p *ProxyEntity) startReverse(tr http.RoundTripper) error {
+	upstream, err := parseReverseUpstream(p.ReverseUpstream)
+	if err != nil {
+		return err
+	}
+	if p.ReversePort == 0 {
+		return errors.New("the port of the reverse proxy is required")
+	}
+	if p.ReverseHTTPS && p.issuer == nil {
+		return errors.New("the reverse proxy serves https only when the https is contained")
+	}
+
+	l, err := net.Listen("tcp", p.IP+":"+strconv.Itoa(int(p.ReversePort)))
+	if err != nil {
+		return err
+	}
+	scheme := "http"
+	if p.ReverseHTTPS {
+		// 客户端直接访问反向代理, 不仿造上游证书
+		issuer := p.issuer.Clone()
+		issuer.Upstream = nil
+		l = tls.NewListener(l, reverseTLSConfig(issuer))
+		scheme = "https"
+	}
+
+	modifier := &reverseModifier{
+		entity:   p,
+		upstream: upstream,
+	}
+	p.reverseProxy = martian.NewProxy()
+	p.reverseProxy.SetRoundTripper(tr)
+	p.reverseProxy.SetDial(p.dial)
+	p.reverseProxy.SetRequestModifier(modifier)
+	p.reverseProxy.SetResponseModifier(modifier)
+
+	log.Printf("starting reverse proxy on %s://%s to %s", scheme, l.Addr().String(), upstream.String())
+	p.reverseListener = l
+	go p.reverseProxy.Serve(l)
+
+	return nil
+}
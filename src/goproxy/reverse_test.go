@@ -0,0 +1,164 @@
+package goproxy
+
+import (
+	"testing"
+)
+
+func newTestReverseModifier(t *testing.T, upstream string) *reverseModifier {
+	t.Helper()
+
+	u, err := parseReverseUpstream(upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &reverseModifier{upstream: u}
+}
+
+func TestParseReverseUpstream(t *testing.T) {
+	tests := []struct {
+		rawurl string
+		result string
+		err    bool
+	}{
+		{"https://staging.example.com/api/", "https://staging.example.com/api", false},
+		{"http://127.0.0.1:8080", "http://127.0.0.1:8080", false},
+		{"https://staging.example.com/api?x=1#top", "https://staging.example.com/api", false},
+		{"ftp://example.com", "", true},
+		{"staging.example.com", "", true},
+		{"https://", "", true},
+		{"://bad", "", true},
+	}
+
+	for _, tt := range tests {
+		u, err := parseReverseUpstream(tt.rawurl)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseReverseUpstream(%q) = %s, want an error", tt.rawurl, u)
+			}
+			continue
+		}
+		if err != nil || u.String() != tt.result {
+			t.Errorf("parseReverseUpstream(%q) = %v, %v, want %s", tt.rawurl, u, err, tt.result)
+		}
+	}
+}
+
+func TestStripBasePath(t *testing.T) {
+	tests := []struct {
+		upstream string
+		path     string
+		result   string
+	}{
+		{"https://up.example.com/api", "/api/users", "/users"},
+		{"https://up.example.com/api", "/api", "/"},
+		{"https://up.example.com/api", "/api/", "/"},
+		{"https://up.example.com/api", "/apiv2/users", "/apiv2/users"},
+		{"https://up.example.com/api", "/other/api/users", "/other/api/users"},
+		{"https://up.example.com/api/v1", "/api/v1/x", "/x"},
+		{"https://up.example.com/a%20b", "/a%20b/x", "/x"},
+		{"https://up.example.com", "/api/users", "/api/users"},
+		{"https://up.example.com/", "/", "/"},
+	}
+
+	for _, tt := range tests {
+		p := newTestReverseModifier(t, tt.upstream)
+		if result := p.stripBasePath(tt.path); result != tt.result {
+			t.Errorf("upstream %s: stripBasePath(%q) = %q, want %q", tt.upstream, tt.path, result, tt.result)
+		}
+	}
+}
+
+func TestRewriteLocation(t *testing.T) {
+	httpFront := &reverseFront{scheme: "http", host: "127.0.0.1:9000"}
+	httpsFront := &reverseFront{scheme: "https", host: "proxy.local"}
+
+	tests := []struct {
+		name     string
+		upstream string
+		location string
+		front    *reverseFront
+		result   string
+	}{
+		{"absolute", "https://up.example.com/api", "https://up.example.com/api/login?next=%2F", httpFront, "http://127.0.0.1:9000/login?next=%2F"},
+		{"https front", "https://up.example.com/api", "https://up.example.com/api/login", httpsFront, "https://proxy.local/login"},
+		{"base path itself", "https://up.example.com/api", "https://up.example.com/api", httpFront, "http://127.0.0.1:9000/"},
+		{"outside the base path", "https://up.example.com/api", "https://up.example.com/static/a.css", httpFront, "http://127.0.0.1:9000/static/a.css"},
+		{"case insensitive host", "https://up.example.com", "https://UP.example.com/x", httpFront, "http://127.0.0.1:9000/x"},
+		{"other scheme", "https://up.example.com", "http://up.example.com/x", httpFront, "http://127.0.0.1:9000/x"},
+		{"same default port", "https://up.example.com", "https://up.example.com:443/x", httpFront, "http://127.0.0.1:9000/x"},
+		{"same explicit port", "http://up.example.com:8080", "http://up.example.com:8080/x", httpFront, "http://127.0.0.1:9000/x"},
+		{"other port", "https://up.example.com", "https://up.example.com:8443/x", httpFront, "https://up.example.com:8443/x"},
+		{"other port of upstream with port", "http://up.example.com:8080", "http://up.example.com:9090/x", httpFront, "http://up.example.com:9090/x"},
+		{"other host", "https://up.example.com/api", "https://sso.example.com/api/login", httpFront, "https://sso.example.com/api/login"},
+		{"parent host", "https://up.example.com", "https://example.com/", httpFront, "https://example.com/"},
+		{"scheme relative", "https://up.example.com/api", "//up.example.com/api/login", httpFront, "http://127.0.0.1:9000/login"},
+		{"scheme relative other host", "https://up.example.com/api", "//cdn.example.com/api/a.js", httpFront, "//cdn.example.com/api/a.js"},
+		{"relative", "https://up.example.com/api", "/api/login?x=1", httpFront, "/login?x=1"},
+		{"relative outside the base path", "https://up.example.com/api", "/login", httpFront, "/login"},
+		{"relative without slash", "https://up.example.com/api", "login", httpFront, "login"},
+		{"query only", "https://up.example.com/api", "?page=2", httpFront, "?page=2"},
+		{"escaped path", "https://up.example.com/api", "/api/files/a%2Fb", httpFront, "/files/a%2Fb"},
+		{"escaped absolute path", "https://up.example.com/api", "https://up.example.com/api/a%2Fb#frag", httpFront, "http://127.0.0.1:9000/a%2Fb#frag"},
+		{"no base path", "https://up.example.com", "https://up.example.com/api/x", httpFront, "http://127.0.0.1:9000/api/x"},
+		{"other scheme without host", "https://up.example.com", "mailto:admin@example.com", httpFront, "mailto:admin@example.com"},
+		{"invalid", "https://up.example.com", "http://[::1", httpFront, "http://[::1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestReverseModifier(t, tt.upstream)
+			if result := p.rewriteLocation(tt.location, tt.front); result != tt.result {
+				t.Fatalf("rewriteLocation(%q) = %q, want %q", tt.location, result, tt.result)
+			}
+		})
+	}
+}
+
+func TestRewriteCookie(t *testing.T) {
+	httpFront := &reverseFront{scheme: "http", host: "127.0.0.1:9000"}
+	httpsFront := &reverseFront{scheme: "https", host: "proxy.local"}
+
+	tests := []struct {
+		name     string
+		upstream string
+		cookie   string
+		front    *reverseFront
+		result   string
+	}{
+		{"plain", "https://up.example.com", "sid=abc", httpFront, "sid=abc"},
+		{"same domain", "https://up.example.com", "sid=abc; Domain=up.example.com; HttpOnly", httpFront, "sid=abc; HttpOnly"},
+		{"parent domain", "https://api.up.example.com", "sid=abc; Domain=example.com; Path=/", httpsFront, "sid=abc; Path=/"},
+		{"parent domain with dot", "https://api.up.example.com", "sid=abc; domain=.Example.COM", httpsFront, "sid=abc"},
+		{"other domain", "https://up.example.com", "sid=abc; Domain=other.com", httpsFront, "sid=abc; Domain=other.com"},
+		{"suffix but not parent", "https://up.example.com", "sid=abc; Domain=ple.com", httpsFront, "sid=abc; Domain=ple.com"},
+		{"child domain", "https://example.com", "sid=abc; Domain=api.example.com", httpsFront, "sid=abc; Domain=api.example.com"},
+		{"secure on http", "https://up.example.com", "sid=abc; Secure; HttpOnly", httpFront, "sid=abc; HttpOnly"},
+		{"secure on https", "https://up.example.com", "sid=abc; Secure; HttpOnly", httpsFront, "sid=abc; Secure; HttpOnly"},
+		{"samesite none on http", "https://up.example.com", "sid=abc; Secure; SameSite=None", httpFront, "sid=abc"},
+		{"samesite none on https", "https://up.example.com", "sid=abc; Secure; SameSite=None", httpsFront, "sid=abc; Secure; SameSite=None"},
+		{"samesite lax on http", "https://up.example.com", "sid=abc; SameSite=Lax", httpFront, "sid=abc; SameSite=Lax"},
+		{"path under the prefix", "https://up.example.com/api", "sid=abc; Path=/api/v1; HttpOnly", httpFront, "sid=abc; Path=/v1; HttpOnly"},
+		{"path equal to the prefix", "https://up.example.com/api", "sid=abc; path=/api", httpFront, "sid=abc; Path=/"},
+		{"path outside the prefix", "https://up.example.com/api", "sid=abc; Path=/apiv2", httpFront, "sid=abc; Path=/apiv2"},
+		{"root path", "https://up.example.com/api", "sid=abc; Path=/", httpFront, "sid=abc; Path=/"},
+		{"relative path", "https://up.example.com/api", "sid=abc; Path=api", httpFront, "sid=abc; Path=api"},
+		{"value with equal signs", "https://up.example.com", "token=a=b==; Max-Age=60", httpFront, "token=a=b==; Max-Age=60"},
+		{
+			"all attributes",
+			"https://up.example.com/api",
+			"sid=abc; Domain=.example.com; Path=/api/auth; Expires=Wed, 21 Oct 2026 07:28:00 GMT; Secure; HttpOnly; SameSite=None",
+			httpFront,
+			"sid=abc; Path=/auth; Expires=Wed, 21 Oct 2026 07:28:00 GMT; HttpOnly",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestReverseModifier(t, tt.upstream)
+			if result := p.rewriteCookie(tt.cookie, tt.front); result != tt.result {
+				t.Fatalf("rewriteCookie(%q) = %q, want %q", tt.cookie, result, tt.result)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package goproxy
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5, https://tools.ietf.org/html/rfc1928
+const (
+	socksVersion = 5
+
+	socksAuthNone         = 0x00
+	socksAuthPassword     = 0x02
+	socksAuthNoAcceptable = 0xff
+
+	// 用户名密码认证, https://tools.ietf.org/html/rfc1929
+	socksPasswordVersion = 1
+
+	socksCmdConnect = 1
+
+	socksAtypIPv4   = 1
+	socksAtypDomain = 3
+	socksAtypIPv6   = 4
+
+	socksRepSucceeded           = 0
+	socksRepGeneralFailure      = 1
+	socksRepCommandNotSupported = 7
+	socksRepAddrNotSupported    = 8
+)
+
+var errSocksAuthFailed = errors.New("socks5 authentication failed")
+
+func (p *ProxyEntity) serveSocks(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return
+		}
+
+		go p.handleSocks(conn)
+	}
+}
+
+func (p *ProxyEntity) handleSocks(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(p.TLSHandShakeTimeout))
+	br := bufio.NewReader(conn)
+
+	target, err := p.socksHandshake(br, conn)
+	if err != nil {
+		log.Printf("socks5 handshake with %s failed, error: %v", conn.RemoteAddr().String(), err)
+		return
+	}
+
+	p.interceptConn(conn, br, target)
+}
+
+// 完成认证并读取CONNECT请求, 返回目标地址
+func (p *ProxyEntity) socksHandshake(br *bufio.Reader, conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("unsupported socks version: %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return "", err
+	}
+
+	method := byte(socksAuthNone)
+	if len(p.SocksUser) > 0 {
+		method = socksAuthPassword
+	}
+	accepted := false
+	for _, m := range methods {
+		if m == method {
+			accepted = true
+			break
+		}
+	}
+	if !accepted {
+		conn.Write([]byte{socksVersion, socksAuthNoAcceptable})
+		return "", errors.New("no acceptable authentication method")
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+
+	if method == socksAuthPassword {
+		if err := p.socksAuthenticate(br, conn); err != nil {
+			return "", err
+		}
+	}
+
+	// 请求: VER CMD RSV ATYP DST.ADDR DST.PORT
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(br, request); err != nil {
+		return "", err
+	}
+	if request[0] != socksVersion {
+		return "", fmt.Errorf("unsupported socks version: %d", request[0])
+	}
+
+	var host string
+	switch request[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		size := net.IPv4len
+		if request[3] == socksAtypIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(br, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socksAtypDomain:
+		size, err := br.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		domain := make([]byte, size)
+		if _, err := io.ReadFull(br, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		socksReply(conn, socksRepAddrNotSupported)
+		return "", fmt.Errorf("unsupported address type: %d", request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(br, port); err != nil {
+		return "", err
+	}
+
+	// 只支持CONNECT
+	if request[1] != socksCmdConnect {
+		socksReply(conn, socksRepCommandNotSupported)
+		return "", fmt.Errorf("unsupported command: %d", request[1])
+	}
+
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	if len(host) == 0 {
+		socksReply(conn, socksRepGeneralFailure)
+		return "", errors.New("the target host is empty")
+	}
+
+	// 连接由后续处理建立, 这里直接返回成功
+	if err := socksReply(conn, socksRepSucceeded); err != nil {
+		return "", err
+	}
+
+	return target, nil
+}
+
+// 用户名密码认证: VER ULEN UNAME PLEN PASSWD
+func (p *ProxyEntity) socksAuthenticate(br *bufio.Reader, conn net.Conn) error {
+	version, err := br.ReadByte()
+	if err != nil {
+		return err
+	}
+	if version != socksPasswordVersion {
+		return fmt.Errorf("unsupported authentication version: %d", version)
+	}
+
+	readField := func() ([]byte, error) {
+		size, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		field := make([]byte, size)
+		_, err = io.ReadFull(br, field)
+		return field, err
+	}
+
+	user, err := readField()
+	if err != nil {
+		return err
+	}
+	password, err := readField()
+	if err != nil {
+		return err
+	}
+
+	userOk := subtle.ConstantTimeCompare(user, []byte(p.SocksUser)) == 1
+	passwordOk := subtle.ConstantTimeCompare(password, []byte(p.SocksPassword)) == 1
+	if !userOk || !passwordOk {
+		conn.Write([]byte{socksPasswordVersion, 1})
+		return errSocksAuthFailed
+	}
+
+	_, err = conn.Write([]byte{socksPasswordVersion, 0})
+	return err
+}
+
+// 回复中的绑定地址固定为 0.0.0.0:0
+func socksReply(conn net.Conn, rep byte) error {
+	_, err := conn.Write([]byte{socksVersion, rep, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
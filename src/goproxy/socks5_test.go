@@ -0,0 +1,243 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// 记录写入数据的连接, 握手只会调用Write
+type recordConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	return c.written.Write(b)
+}
+
+func TestSocksHandshake(t *testing.T) {
+	var (
+		greetNone     = []byte{5, 1, socksAuthNone}
+		greetPassword = []byte{5, 1, socksAuthPassword}
+		chooseNone    = []byte{5, socksAuthNone}
+		choosePass    = []byte{5, socksAuthPassword}
+		authOk        = []byte{socksPasswordVersion, 0}
+		authFailed    = []byte{socksPasswordVersion, 1}
+	)
+	reply := func(rep byte) []byte {
+		return []byte{5, rep, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0}
+	}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	credentials := func(user, password string) []byte {
+		b := []byte{socksPasswordVersion, byte(len(user))}
+		b = append(b, user...)
+		b = append(b, byte(len(password)))
+		return append(b, password...)
+	}
+
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		input    []byte
+		target   string
+		err      error // 为nil时只检查是否出错
+		wantErr  bool
+		written  []byte
+	}{
+		{
+			name:    "ipv4",
+			input:   join(greetNone, []byte{5, socksCmdConnect, 0, socksAtypIPv4, 10, 0, 0, 1, 0x01, 0xbb}),
+			target:  "10.0.0.1:443",
+			written: join(chooseNone, reply(socksRepSucceeded)),
+		},
+		{
+			name:    "domain",
+			input:   join(greetNone, []byte{5, socksCmdConnect, 0, socksAtypDomain, 11}, []byte("example.com"), []byte{0, 80}),
+			target:  "example.com:80",
+			written: join(chooseNone, reply(socksRepSucceeded)),
+		},
+		{
+			name:    "ipv6",
+			input:   join(greetNone, []byte{5, socksCmdConnect, 0, socksAtypIPv6}, net.ParseIP("2001:db8::1"), []byte{0x1f, 0x90}),
+			target:  "[2001:db8::1]:8080",
+			written: join(chooseNone, reply(socksRepSucceeded)),
+		},
+		{
+			name:    "multiple methods",
+			input:   join([]byte{5, 3, 0x80, socksAuthPassword, socksAuthNone}, []byte{5, socksCmdConnect, 0, socksAtypIPv4, 127, 0, 0, 1, 0, 80}),
+			target:  "127.0.0.1:80",
+			written: join(chooseNone, reply(socksRepSucceeded)),
+		},
+		{
+			name:     "password",
+			user:     "user",
+			password: "secret",
+			input:    join(greetPassword, credentials("user", "secret"), []byte{5, socksCmdConnect, 0, socksAtypIPv4, 127, 0, 0, 1, 0, 80}),
+			target:   "127.0.0.1:80",
+			written:  join(choosePass, authOk, reply(socksRepSucceeded)),
+		},
+		{
+			name:     "wrong password",
+			user:     "user",
+			password: "secret",
+			input:    join(greetPassword, credentials("user", "wrong")),
+			err:      errSocksAuthFailed,
+			written:  join(choosePass, authFailed),
+		},
+		{
+			name:     "wrong user",
+			user:     "user",
+			password: "secret",
+			input:    join(greetPassword, credentials("admin", "secret")),
+			err:      errSocksAuthFailed,
+			written:  join(choosePass, authFailed),
+		},
+		{
+			name:     "password required",
+			user:     "user",
+			password: "secret",
+			input:    greetNone,
+			wantErr:  true,
+			written:  []byte{5, socksAuthNoAcceptable},
+		},
+		{
+			name:     "unsupported auth version",
+			user:     "user",
+			password: "secret",
+			input:    join(greetPassword, []byte{2, 4}, []byte("user")),
+			wantErr:  true,
+			written:  choosePass,
+		},
+		{
+			name:     "short credentials",
+			user:     "user",
+			password: "secret",
+			input:    join(greetPassword, []byte{socksPasswordVersion, 4}, []byte("us")),
+			err:      io.ErrUnexpectedEOF,
+			written:  choosePass,
+		},
+		{
+			name:    "socks4",
+			input:   []byte{4, 1, 0, 80, 127, 0, 0, 1, 0},
+			wantErr: true,
+		},
+		{
+			name:  "empty input",
+			input: []byte{},
+			err:   io.EOF,
+		},
+		{
+			name:  "short greeting",
+			input: []byte{5},
+			err:   io.ErrUnexpectedEOF,
+		},
+		{
+			name:  "short methods",
+			input: []byte{5, 2, socksAuthNone},
+			err:   io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "no methods",
+			input:   []byte{5, 0},
+			wantErr: true,
+			written: []byte{5, socksAuthNoAcceptable},
+		},
+		{
+			name:    "short request",
+			input:   join(greetNone, []byte{5, socksCmdConnect}),
+			err:     io.ErrUnexpectedEOF,
+			written: chooseNone,
+		},
+		{
+			name:    "wrong request version",
+			input:   join(greetNone, []byte{4, socksCmdConnect, 0, socksAtypIPv4, 127, 0, 0, 1, 0, 80}),
+			wantErr: true,
+			written: chooseNone,
+		},
+		{
+			name:    "short ipv4",
+			input:   join(greetNone, []byte{5, socksCmdConnect, 0, socksAtypIPv4, 127, 0}),
+			err:     io.ErrUnexpectedEOF,
+			written: chooseNone,
+		},
+		{
+			name:    "short domain",
+			input:   join(greetNone, []byte{5, socksCmdConnect, 0, socksAtypDomain, 11}, []byte("example")),
+			err:     io.ErrUnexpectedEOF,
+			written: chooseNone,
+		},
+		{
+			name:    "missing domain length",
+			input:   join(greetNone, []byte{5, socksCmdConnect, 0, socksAtypDomain}),
+			err:     io.EOF,
+			written: chooseNone,
+		},
+		{
+			name:    "short port",
+			input:   join(greetNone, []byte{5, socksCmdConnect, 0, socksAtypIPv4, 127, 0, 0, 1, 0}),
+			err:     io.ErrUnexpectedEOF,
+			written: chooseNone,
+		},
+		{
+			name:    "empty domain",
+			input:   join(greetNone, []byte{5, socksCmdConnect, 0, socksAtypDomain, 0, 0, 80}),
+			wantErr: true,
+			written: join(chooseNone, reply(socksRepGeneralFailure)),
+		},
+		{
+			name:    "bind command",
+			input:   join(greetNone, []byte{5, 2, 0, socksAtypIPv4, 127, 0, 0, 1, 0, 80}),
+			wantErr: true,
+			written: join(chooseNone, reply(socksRepCommandNotSupported)),
+		},
+		{
+			name:    "udp associate command",
+			input:   join(greetNone, []byte{5, 3, 0, socksAtypIPv4, 127, 0, 0, 1, 0, 80}),
+			wantErr: true,
+			written: join(chooseNone, reply(socksRepCommandNotSupported)),
+		},
+		{
+			name:    "unsupported address type",
+			input:   join(greetNone, []byte{5, socksCmdConnect, 0, 5, 127, 0, 0, 1, 0, 80}),
+			wantErr: true,
+			written: join(chooseNone, reply(socksRepAddrNotSupported)),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &ProxyEntity{SocksUser: tt.user, SocksPassword: tt.password}
+			conn := &recordConn{}
+
+			target, err := p.socksHandshake(bufio.NewReader(bytes.NewReader(tt.input)), conn)
+			switch {
+			case tt.err != nil:
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("error = %v, want %v", err, tt.err)
+				}
+			case tt.wantErr:
+				if err == nil {
+					t.Fatalf("expected an error, got target %q", target)
+				}
+			default:
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if target != tt.target {
+					t.Fatalf("target = %q, want %q", target, tt.target)
+				}
+			}
+
+			if !bytes.Equal(conn.written.Bytes(), tt.written) {
+				t.Fatalf("written = %v, want %v", conn.written.Bytes(), tt.written)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package goproxy
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+func (p *ProxyEntity) serveTransparent(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return
+		}
+
+		go p.handleTransparent(conn)
+	}
+}
+
+// 处理被iptables/nftables重定向的连接, 按原始的目标地址处理
+func (p *ProxyEntity) handleTransparent(conn net.Conn) {
+	defer conn.Close()
+
+	target, err := originalDestination(conn)
+	if err != nil {
+		log.Printf("failed to get the original destination of %s, error: %v", conn.RemoteAddr().String(), err)
+		return
+	}
+
+	// 直接连接透明代理的端口时原始地址就是自己, 转发会造成循环
+	if target == conn.LocalAddr().String() || isLocalListenAddr(target, p.TransparentPort) {
+		log.Printf("refused the connection from %s, the original destination is the proxy itself", conn.RemoteAddr().String())
+		return
+	}
+
+	p.interceptConn(conn, bufio.NewReader(conn), target)
+}
+
+// 目标是否为本机上透明代理监听的端口
+func isLocalListenAddr(target string, port uint16) bool {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil || portStr != strconv.Itoa(int(port)) {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,70 @@
+//go:build linux
+// +build linux
+
+package goproxy
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+const transparentSupported = true
+
+// linux/netfilter_ipv4.h 和 linux/netfilter_ipv6/ip6_tables.h
+const (
+	soOriginalDst     = 80
+	ip6tSoOriginalDst = 80
+)
+
+// 通过SO_ORIGINAL_DST获取重定向之前的目标地址
+func originalDestination(conn net.Conn) (string, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", errors.New("not a tcp connection")
+	}
+
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+
+	var target string
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+		if err == nil {
+			target = sockaddrInTarget(mreq.Multiaddr)
+			return
+		}
+
+		info, err6 := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, ip6tSoOriginalDst)
+		if err6 != nil {
+			sockErr = err
+			return
+		}
+		target = sockaddrIn6Target(&info.Addr)
+	})
+	if err != nil {
+		return "", err
+	}
+	if sockErr != nil {
+		return "", sockErr
+	}
+
+	return target, nil
+}
+
+// sockaddr_in: family(2) port(2) addr(4) zero(8), 端口为网络字节序
+func sockaddrInTarget(addr [16]byte) string {
+	port := int(addr[2])<<8 | int(addr[3])
+	return net.JoinHostPort(net.IP(addr[4:8]).String(), strconv.Itoa(port))
+}
+
+// IPv6使用sockaddr_in6, 端口同样为网络字节序
+func sockaddrIn6Target(addr *syscall.RawSockaddrInet6) string {
+	port := (*[2]byte)(unsafe.Pointer(&addr.Port))
+	return net.JoinHostPort(net.IP(addr.Addr[:]).String(), strconv.Itoa(int(port[0])<<8|int(port[1])))
+}
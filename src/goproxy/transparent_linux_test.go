@@ -0,0 +1,86 @@
+//go:build linux
+// +build linux
+
+package goproxy
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func TestSockaddrInTarget(t *testing.T) {
+	tests := []struct {
+		addr   [16]byte
+		target string
+	}{
+		{[16]byte{syscall.AF_INET, 0, 0x01, 0xbb, 93, 184, 216, 34}, "93.184.216.34:443"},
+		{[16]byte{syscall.AF_INET, 0, 0x00, 0x50, 10, 0, 0, 1}, "10.0.0.1:80"},
+		{[16]byte{syscall.AF_INET, 0, 0xff, 0xff, 127, 0, 0, 1}, "127.0.0.1:65535"},
+	}
+
+	for _, tt := range tests {
+		if target := sockaddrInTarget(tt.addr); target != tt.target {
+			t.Errorf("sockaddrInTarget(%v) = %q, want %q", tt.addr, target, tt.target)
+		}
+	}
+}
+
+func TestSockaddrIn6Target(t *testing.T) {
+	tests := []struct {
+		ip     string
+		port   [2]byte
+		target string
+	}{
+		{"2001:db8::1", [2]byte{0x01, 0xbb}, "[2001:db8::1]:443"},
+		{"::1", [2]byte{0x1f, 0x90}, "[::1]:8080"},
+		{"::ffff:10.0.0.1", [2]byte{0x00, 0x50}, "10.0.0.1:80"},
+	}
+
+	for _, tt := range tests {
+		addr := syscall.RawSockaddrInet6{Family: syscall.AF_INET6}
+		copy(addr.Addr[:], net.ParseIP(tt.ip).To16())
+		// 与内核一致, 按网络字节序写入端口
+		*(*[2]byte)(unsafe.Pointer(&addr.Port)) = tt.port
+
+		if target := sockaddrIn6Target(&addr); target != tt.target {
+			t.Errorf("sockaddrIn6Target(%s) = %q, want %q", tt.ip, target, tt.target)
+		}
+	}
+}
+
+func TestOriginalDestinationWithoutRedirect(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	if _, err := originalDestination(server); err == nil {
+		t.Fatal("expected an error for a non-tcp connection")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err == nil {
+			defer conn.Close()
+			buf := make([]byte, 1)
+			conn.Read(buf)
+		}
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 没有经过重定向的连接没有原始目标地址
+	if target, err := originalDestination(conn); err == nil {
+		t.Fatalf("expected an error for a connection which is not redirected, got %q", target)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package goproxy
+
+import (
+	"errors"
+	"net"
+)
+
+const transparentSupported = false
+
+// 只有linux支持SO_ORIGINAL_DST
+func originalDestination(conn net.Conn) (string, error) {
+	return "", errors.New("the transparent mode is only supported on linux")
+}
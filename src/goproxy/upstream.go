@@ -0,0 +1,115 @@
+package goproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"mitmgo/src/core"
+	"mitmgo/src/core/common"
+	"net"
+	"time"
+)
+
+// 按host选择TLS配置连接上游服务器, 用于martian, 只支持http/1.1
+func (p *ProxyEntity) dialTLS(ctx context.Context, network string, addr string) (net.Conn, error) {
+	return p.handshakeUpstream(ctx, network, addr, "", false, false)
+}
+
+// 用于h2的请求, 由上游服务器选择h2或者http/1.1
+func (p *ProxyEntity) dialTLSHTTP2(ctx context.Context, network string, addr string) (net.Conn, error) {
+	return p.handshakeUpstream(ctx, network, addr, "", false, true)
+}
+
+// serverName为空时使用addr中的host, forceSkipVerify为true时忽略证书验证的结果
+// http2为false时不协商h2, 为true时没有配置ALPN则同时提供h2和http/1.1
+func (p *ProxyEntity) handshakeUpstream(ctx context.Context, network string, addr string, serverName string, forceSkipVerify bool, http2 bool) (*tls.Conn, error) {
+	conn, err := p.dialUpstream(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	config := p.upstreamTLS.ConfigFor(addr)
+	if len(serverName) > 0 {
+		config.ServerName = serverName
+	}
+	if http2 {
+		if len(config.NextProtos) == 0 {
+			config.NextProtos = []string{"h2", "http/1.1"}
+		}
+	} else {
+		protos := make([]string, 0, len(config.NextProtos))
+		for _, proto := range config.NextProtos {
+			if proto != "h2" {
+				protos = append(protos, proto)
+			}
+		}
+		config.NextProtos = protos
+	}
+
+	// 自行验证证书链, 验证失败时也可以记录证书信息
+	skipVerify := config.InsecureSkipVerify || forceSkipVerify
+	config.InsecureSkipVerify = true
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		err := core.VerifyServerCertificate(state, config.ServerName, config.RootCAs)
+		p.recordServerCert(addr, config.ServerName, state, err)
+		if err != nil && !skipVerify {
+			return fmt.Errorf("tls: failed to verify certificate: %v", err)
+		}
+		return nil
+	}
+
+	if p.TLSHandShakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(p.TLSHandShakeTimeout))
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return tlsConn, nil
+}
+
+// 获取上游服务器的证书, 用于仿造叶子证书, 证书无效时也返回
+func (p *ProxyEntity) upstreamCertificate(serverName string, addr string) (*x509.Certificate, error) {
+	conn, err := p.handshakeUpstream(context.Background(), "tcp", addr, serverName, true, false)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, errors.New("the server did not send any certificate")
+	}
+
+	return certs[0], nil
+}
+
+// 记录上游服务器的证书, 同一个host只在证书变化时重新记录
+func (p *ProxyEntity) recordServerCert(host string, serverName string, state tls.ConnectionState, verifyErr error) {
+	record := core.NewServerCertResult(host, serverName, state, verifyErr)
+	record.Id = p.Id
+
+	p.lock_serverCerts.Lock()
+	if fingerprint, ok := p.serverCerts[host]; ok && fingerprint == record.FingerprintSHA256 {
+		p.lock_serverCerts.Unlock()
+		return
+	}
+	p.serverCerts[host] = record.FingerprintSHA256
+	p.lock_serverCerts.Unlock()
+
+	resultStr := common.ToJsonEncodeStruct(record)
+	if len(p.RemoteOutputAddr) > 0 {
+		if p.deliverer != nil {
+			p.deliverer.PushServerCert(*record)
+		}
+	} else {
+		fmt.Print(resultStr + "\r\n")
+	}
+	// 保存到结果集中, 退出时写入日志
+	p.ResultSet.Push(resultStr)
+}
@@ -0,0 +1,256 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/google/martian/v3"
+	"io"
+	"mitmgo/src/core"
+	"mitmgo/src/core/common"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const webSocketContextKey = "mitmgo.websocket"
+
+// 一个WebSocket连接的记录状态, 同一个连接中结构相同的消息只记录一次
+type webSocketFlow struct {
+	flowId      string
+	link        string
+	record      bool // 握手请求在范围内时才记录消息
+	hashes      map[string]struct{}
+	lock_hashes sync.Mutex
+}
+
+// 一个方向上正在接收的消息, 分片的消息合并后记录
+type webSocketMessage struct {
+	opcode    int
+	buf       bytes.Buffer
+	length    int64
+	truncated bool
+	reserved  bool // 设置了RSV位, 负载经过扩展处理(例如压缩), 无法解码
+}
+
+func headerHasToken(header http.Header, name string, token string) bool {
+	for _, v := range header[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// 是否为WebSocket的握手请求或者响应
+func isWebSocketUpgrade(header http.Header) bool {
+	return headerHasToken(header, "Connection", "upgrade") && strings.EqualFold(header.Get("Upgrade"), "websocket")
+}
+
+// 接管握手成功的连接, 在客户端和服务端之间转发帧并记录消息
+// 需要同步处理, ModifyResponse返回后martian会继续读取请求
+func (p *ProxyEntity) interceptWebSocket(ctx *martian.Context, res *http.Response) {
+	upstream, ok := res.Body.(io.ReadWriteCloser)
+	if !ok {
+		return
+	}
+
+	conn, brw, err := ctx.Session().Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	defer upstream.Close()
+
+	// 握手的响应没有响应体, martian会关闭res.Body
+	res.Body = http.NoBody
+	if err := res.Write(brw); err != nil {
+		return
+	}
+	if err := brw.Flush(); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	ws := &webSocketFlow{
+		flowId: ctx.ID(),
+		link:   res.Request.URL.String(),
+		hashes: make(map[string]struct{}),
+	}
+	if v, ok := ctx.Get(webSocketContextKey); ok {
+		ws.record, _ = v.(bool)
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		p.copyWebSocketFrames(upstream, brw.Reader, ws, core.WebSocketDirectionSend)
+		done <- struct{}{}
+	}()
+	go func() {
+		p.copyWebSocketFrames(conn, bufio.NewReader(upstream), ws, core.WebSocketDirectionReceive)
+		done <- struct{}{}
+	}()
+
+	// 任意一方断开或者代理关闭时断开两端
+	var closed chan struct{}
+	if p.innerListener != nil {
+		closed = p.innerListener.closed
+	}
+	select {
+	case <-done:
+	case <-closed:
+	}
+	conn.Close()
+	upstream.Close()
+	<-done
+}
+
+// 原样转发src中的帧, 解码负载后记录消息, https://tools.ietf.org/html/rfc6455#section-5.2
+func (p *ProxyEntity) copyWebSocketFrames(dst io.Writer, src *bufio.Reader, ws *webSocketFlow, direction string) error {
+	header := make([]byte, 14)
+	buf := make([]byte, 32*1024)
+	message := &webSocketMessage{}
+	control := &webSocketMessage{}
+
+	for {
+		// FIN RSV OPCODE, MASK LEN, 扩展长度, 掩码
+		if _, err := io.ReadFull(src, header[:2]); err != nil {
+			return err
+		}
+		fin := header[0]&0x80 != 0
+		reserved := header[0]&0x70 != 0
+		opcode := int(header[0] & 0x0f)
+		masked := header[1]&0x80 != 0
+		size := 2
+		length := int64(header[1] & 0x7f)
+		switch length {
+		case 126:
+			if _, err := io.ReadFull(src, header[2:4]); err != nil {
+				return err
+			}
+			length = int64(binary.BigEndian.Uint16(header[2:4]))
+			size = 4
+		case 127:
+			if _, err := io.ReadFull(src, header[2:10]); err != nil {
+				return err
+			}
+			length = int64(binary.BigEndian.Uint64(header[2:10]))
+			size = 10
+		}
+		if length < 0 {
+			return fmt.Errorf("invalid websocket frame length: %d", length)
+		}
+		var mask []byte
+		if masked {
+			if _, err := io.ReadFull(src, header[size:size+4]); err != nil {
+				return err
+			}
+			mask = header[size : size+4]
+			size += 4
+		}
+		if _, err := dst.Write(header[:size]); err != nil {
+			return err
+		}
+
+		// 控制帧可以插在分片的消息之间
+		current := message
+		switch {
+		case opcode >= core.WebSocketOpClose:
+			current = control
+			current.reset(opcode)
+		case opcode != core.WebSocketOpContinuation:
+			current.reset(opcode)
+		}
+		if reserved {
+			current.reserved = true
+		}
+
+		var pos int64
+		for pos < length {
+			n := int64(len(buf))
+			if length-pos < n {
+				n = length - pos
+			}
+			if _, err := io.ReadFull(src, buf[:n]); err != nil {
+				return err
+			}
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return err
+			}
+			if ws.record {
+				current.write(buf[:n], mask, pos, p.MaxBodySize)
+			}
+			pos += n
+		}
+		current.length += length
+
+		// ping和pong不记录, 设置了RSV位的消息不是原始内容, 也不记录
+		if fin && ws.record && !current.reserved && current.opcode != core.WebSocketOpPing && current.opcode != core.WebSocketOpPong {
+			p.recordWebSocketMessage(ws, direction, current)
+		}
+	}
+}
+
+func (p *webSocketMessage) reset(opcode int) {
+	p.opcode = opcode
+	p.buf.Reset()
+	p.length = 0
+	p.truncated = false
+	p.reserved = false
+}
+
+// 保存解码后的负载, 超过limit的部分丢弃, offset为数据在帧负载中的位置
+func (p *webSocketMessage) write(b []byte, mask []byte, offset int64, limit int) {
+	n := limit - p.buf.Len()
+	if n <= 0 {
+		p.truncated = true
+		return
+	}
+	if len(b) > n {
+		b = b[:n]
+		p.truncated = true
+	}
+
+	for i, c := range b {
+		if mask != nil {
+			c ^= mask[(offset+int64(i))%4]
+		}
+		p.buf.WriteByte(c)
+	}
+}
+
+func (p *ProxyEntity) recordWebSocketMessage(ws *webSocketFlow, direction string, message *webSocketMessage) {
+	record := core.NewWebSocketMessage(ws.flowId,
+		ws.link,
+		direction,
+		message.opcode,
+		message.buf.Bytes(),
+		message.length,
+		message.truncated)
+	record.Id = p.Id
+	record.Timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+
+	ws.lock_hashes.Lock()
+	if _, ok := ws.hashes[record.Hash]; ok {
+		ws.lock_hashes.Unlock()
+		return
+	}
+	ws.hashes[record.Hash] = struct{}{}
+	ws.lock_hashes.Unlock()
+
+	resultStr := common.ToJsonEncodeStruct(record)
+	if len(p.RemoteOutputAddr) > 0 {
+		if p.deliverer != nil {
+			p.deliverer.PushWebSocketMessage(*record)
+		}
+	} else {
+		fmt.Print(resultStr + "\r\n")
+	}
+	// 保存到结果集中, 退出时写入日志
+	p.ResultSet.Push(resultStr)
+}
@@ -0,0 +1,281 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"mitmgo/src/core"
+	"net"
+	"strings"
+	"testing"
+)
+
+// 构造一个帧, mask不为空时对负载进行掩码处理
+func webSocketFrame(fin bool, rsv byte, opcode int, payload []byte, mask []byte) []byte {
+	b0 := byte(opcode) | rsv<<4
+	if fin {
+		b0 |= 0x80
+	}
+	frame := []byte{b0}
+
+	var b1 byte
+	if mask != nil {
+		b1 = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, b1|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, b1|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, b1|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+
+	if mask == nil {
+		return append(frame, payload...)
+	}
+	frame = append(frame, mask...)
+	for i, c := range payload {
+		frame = append(frame, c^mask[i%4])
+	}
+
+	return frame
+}
+
+// 转发input中的帧, 返回转发的数据和记录的消息
+func copyTestFrames(t *testing.T, p *ProxyEntity, input []byte) ([]byte, []core.WebSocketMessage) {
+	t.Helper()
+
+	ws := &webSocketFlow{
+		flowId: "flow",
+		link:   "ws://example.com/socket",
+		record: true,
+		hashes: make(map[string]struct{}),
+	}
+	dst := new(bytes.Buffer)
+	err := p.copyWebSocketFrames(dst, bufio.NewReader(bytes.NewReader(input)), ws, core.WebSocketDirectionSend)
+	if err != io.EOF {
+		t.Fatalf("copyWebSocketFrames returned %v, want io.EOF", err)
+	}
+
+	// ResultSet是栈, 倒序取出
+	var messages []core.WebSocketMessage
+	for {
+		v := p.ResultSet.Pop()
+		if v == nil {
+			break
+		}
+		var message core.WebSocketMessage
+		if err := json.Unmarshal([]byte(v.(string)), &message); err != nil {
+			t.Fatal(err)
+		}
+		messages = append([]core.WebSocketMessage{message}, messages...)
+	}
+
+	return dst.Bytes(), messages
+}
+
+func TestCopyWebSocketFrames(t *testing.T) {
+	mask := []byte{0x37, 0xfa, 0x21, 0x3d}
+	medium := bytes.Repeat([]byte("0123456789"), 30)
+	large := bytes.Repeat([]byte{0xab}, 70000)
+
+	type message struct {
+		opcode    int
+		payload   string // 二进制内容为base64
+		length    int64
+		truncated bool
+	}
+	tests := []struct {
+		name     string
+		maxSize  int
+		frames   [][]byte
+		messages []message
+	}{
+		{
+			name:     "unmasked text",
+			frames:   [][]byte{webSocketFrame(true, 0, core.WebSocketOpText, []byte("Hello"), nil)},
+			messages: []message{{core.WebSocketOpText, "Hello", 5, false}},
+		},
+		{
+			// RFC 6455 5.7 中的示例
+			name:     "masked text",
+			frames:   [][]byte{{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58}},
+			messages: []message{{core.WebSocketOpText, "Hello", 5, false}},
+		},
+		{
+			name:     "16-bit length",
+			frames:   [][]byte{webSocketFrame(true, 0, core.WebSocketOpText, medium, mask)},
+			messages: []message{{core.WebSocketOpText, string(medium), 300, false}},
+		},
+		{
+			name:     "64-bit length",
+			maxSize:  len(large),
+			frames:   [][]byte{webSocketFrame(true, 0, core.WebSocketOpBinary, large, mask)},
+			messages: []message{{core.WebSocketOpBinary, base64.StdEncoding.EncodeToString(large), 70000, false}},
+		},
+		{
+			name: "fragmented text with an interleaved ping",
+			frames: [][]byte{
+				webSocketFrame(false, 0, core.WebSocketOpText, []byte("Hel"), mask),
+				webSocketFrame(true, 0, core.WebSocketOpPing, []byte("ping"), []byte{1, 2, 3, 4}),
+				webSocketFrame(false, 0, core.WebSocketOpContinuation, []byte("lo, "), []byte{5, 6, 7, 8}),
+				webSocketFrame(true, 0, core.WebSocketOpContinuation, []byte("world"), nil),
+			},
+			messages: []message{{core.WebSocketOpText, "Hello, world", 12, false}},
+		},
+		{
+			name: "fragmented text with an interleaved close",
+			frames: [][]byte{
+				webSocketFrame(false, 0, core.WebSocketOpText, []byte("Hel"), mask),
+				webSocketFrame(true, 0, core.WebSocketOpClose, []byte{0x03, 0xe8}, mask),
+				webSocketFrame(true, 0, core.WebSocketOpContinuation, []byte("lo"), mask),
+			},
+			messages: []message{
+				{core.WebSocketOpClose, "A+g=", 2, false},
+				{core.WebSocketOpText, "Hello", 5, false},
+			},
+		},
+		{
+			name:     "truncated",
+			maxSize:  4,
+			frames:   [][]byte{webSocketFrame(true, 0, core.WebSocketOpText, []byte("Hello, world"), mask)},
+			messages: []message{{core.WebSocketOpText, "Hell", 12, true}},
+		},
+		{
+			name:    "truncated across fragments",
+			maxSize: 5,
+			frames: [][]byte{
+				webSocketFrame(false, 0, core.WebSocketOpText, []byte("Hel"), mask),
+				webSocketFrame(true, 0, core.WebSocketOpContinuation, []byte("lo, world"), mask),
+			},
+			messages: []message{{core.WebSocketOpText, "Hello", 12, true}},
+		},
+		{
+			name:     "truncated large frame",
+			maxSize:  64 * 1024,
+			frames:   [][]byte{webSocketFrame(true, 0, core.WebSocketOpBinary, large, nil)},
+			messages: []message{{core.WebSocketOpBinary, base64.StdEncoding.EncodeToString(large[:64*1024]), 70000, true}},
+		},
+		{
+			name: "compressed",
+			frames: [][]byte{
+				webSocketFrame(true, 4, core.WebSocketOpText, []byte{0xf2, 0x48, 0xcd, 0xc9, 0xc9, 0x07, 0x00}, mask),
+				webSocketFrame(false, 4, core.WebSocketOpText, []byte{0xf2, 0x48}, mask),
+				webSocketFrame(true, 0, core.WebSocketOpContinuation, []byte{0xcd, 0xc9, 0xc9, 0x07, 0x00}, mask),
+				webSocketFrame(true, 0, core.WebSocketOpText, []byte("plain"), mask),
+			},
+			messages: []message{{core.WebSocketOpText, "plain", 5, false}},
+		},
+		{
+			name: "dedup",
+			frames: [][]byte{
+				webSocketFrame(true, 0, core.WebSocketOpText, []byte(`{"type":"chat","text":"hi"}`), mask),
+				webSocketFrame(true, 0, core.WebSocketOpText, []byte(`{"type":"chat","text":"hello again"}`), mask),
+				webSocketFrame(true, 0, core.WebSocketOpText, []byte(`{"type":"join","room":1}`), mask),
+				webSocketFrame(true, 0, core.WebSocketOpText, []byte(`[{"id":1}]`), mask),
+				webSocketFrame(true, 0, core.WebSocketOpText, []byte(`[{"id":2},{"name":"x"}]`), mask),
+				webSocketFrame(true, 0, core.WebSocketOpText, []byte("plain"), mask),
+				webSocketFrame(true, 0, core.WebSocketOpText, []byte("plain"), mask),
+				webSocketFrame(true, 0, core.WebSocketOpBinary, []byte("plain"), mask),
+			},
+			messages: []message{
+				{core.WebSocketOpText, `{"type":"chat","text":"hi"}`, 27, false},
+				{core.WebSocketOpText, `{"type":"join","room":1}`, 24, false},
+				{core.WebSocketOpText, `[{"id":1}]`, 10, false},
+				{core.WebSocketOpText, "plain", 5, false},
+				{core.WebSocketOpBinary, "cGxhaW4=", 5, false},
+			},
+		},
+		{
+			name: "ping and pong",
+			frames: [][]byte{
+				webSocketFrame(true, 0, core.WebSocketOpPing, []byte("ping"), mask),
+				webSocketFrame(true, 0, core.WebSocketOpPong, []byte("pong"), nil),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProxyEntity()
+			if tt.maxSize > 0 {
+				p.MaxBodySize = tt.maxSize
+			}
+
+			input := bytes.Join(tt.frames, nil)
+			forwarded, messages := copyTestFrames(t, p, input)
+			if !bytes.Equal(forwarded, input) {
+				t.Fatal("the frames are not forwarded unchanged")
+			}
+
+			if len(messages) != len(tt.messages) {
+				t.Fatalf("recorded %d messages, want %d: %+v", len(messages), len(tt.messages), messages)
+			}
+			for i, want := range tt.messages {
+				got := messages[i]
+				if got.Opcode != want.opcode || got.Payload != want.payload || got.Length != want.length || got.Truncated != want.truncated {
+					t.Errorf("message %d = {%d %.40q %d %v}, want {%d %.40q %d %v}", i,
+						got.Opcode, got.Payload, got.Length, got.Truncated,
+						want.opcode, want.payload, want.length, want.truncated)
+				}
+				if got.FlowId != "flow" || got.Link != "ws://example.com/socket" || got.Direction != core.WebSocketDirectionSend || got.Id != "test" {
+					t.Errorf("message %d = %+v", i, got)
+				}
+			}
+		})
+	}
+}
+
+// 不完整的帧返回错误, 已经读取的部分原样转发
+func TestCopyWebSocketFramesShortInput(t *testing.T) {
+	frame := webSocketFrame(true, 0, core.WebSocketOpText, bytes.Repeat([]byte("a"), 300), []byte{1, 2, 3, 4})
+
+	for _, size := range []int{1, 3, 5, 7, 100} {
+		p := newTestProxyEntity()
+		ws := &webSocketFlow{record: true, hashes: make(map[string]struct{})}
+		dst := new(bytes.Buffer)
+		err := p.copyWebSocketFrames(dst, bufio.NewReader(bytes.NewReader(frame[:size])), ws, core.WebSocketDirectionSend)
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("%d bytes: error = %v, want io.ErrUnexpectedEOF", size, err)
+		}
+		if p.ResultSet.Count() != 0 {
+			t.Errorf("%d bytes: a message is recorded", size)
+		}
+	}
+}
+
+// 没有在范围内的连接只转发不记录
+func TestCopyWebSocketFramesOverPipe(t *testing.T) {
+	p := newTestProxyEntity()
+	ws := &webSocketFlow{record: false, hashes: make(map[string]struct{})}
+
+	client, proxy := net.Pipe()
+	upstream, server := net.Pipe()
+	go func() {
+		p.copyWebSocketFrames(upstream, bufio.NewReader(proxy), ws, core.WebSocketDirectionSend)
+		upstream.Close()
+	}()
+
+	frame := webSocketFrame(true, 0, core.WebSocketOpText, []byte(strings.Repeat("x", 1000)), []byte{1, 2, 3, 4})
+	go func() {
+		client.Write(frame)
+		client.Close()
+	}()
+
+	received, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, frame) {
+		t.Fatal("the frame is not forwarded unchanged")
+	}
+	if p.ResultSet.Count() != 0 {
+		t.Fatal("the message is recorded for a connection out of scope")
+	}
+}
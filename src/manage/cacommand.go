@@ -0,0 +1,58 @@
+package manage
+
+import (
+	"errors"
+	"fmt"
+	opt "github.com/pborman/getopt"
+	"mitmgo/src/core"
+	"path/filepath"
+)
+
+// ca子命令, 例如: mitmgo ca export --output-dir ./CA/export
+func (p *MITMManager) runCACommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("missing the ca command, available: export")
+	}
+
+	switch args[0] {
+	case "export":
+		return p.exportCA(args)
+	}
+
+	return fmt.Errorf("unknown ca command: %s, available: export", args[0])
+}
+
+// 导出CA证书的各种格式, 用于在设备上安装, 并打印指纹
+func (p *MITMManager) exportCA(args []string) error {
+	set := opt.New()
+	set.SetProgram("mitmgo ca export")
+	certPath := set.StringLong("cert", 'c', p.Setting.Ca, "a path of cert file, default: ./CA/ca.pem")
+	password := set.StringLong("ca-password", 0, p.Setting.CAPassword, "the password of the pkcs#12 cert file")
+	outputDir := set.StringLong("output-dir", 'o', "", "the directory which saves the exported files, default: <the directory of the cert>/export")
+	p12Password := set.StringLong("p12-password", 0, "", "the password of the exported pkcs#12 file, default: empty")
+	set.Parse(args)
+
+	cert, err := core.LoadCACert(*certPath, *password)
+	if err != nil {
+		return err
+	}
+
+	if len(*outputDir) == 0 {
+		*outputDir = filepath.Join(filepath.Dir(*certPath), "export")
+	}
+
+	paths, err := core.ExportCAFiles(cert, *outputDir, *p12Password)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("subject: %s\r\n", cert.Subject.String())
+	fmt.Printf("not after: %s\r\n", cert.NotAfter.Format("2006-01-02 15:04:05"))
+	fmt.Printf("SHA-1 fingerprint: %s\r\n", core.FingerprintSHA1(cert))
+	fmt.Printf("SHA-256 fingerprint: %s\r\n", core.FingerprintSHA256(cert))
+	for i, path := range paths {
+		fmt.Printf("%s: %s\r\n", core.CAExportFormats[i].Description, path)
+	}
+
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package manage
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// SIGUSR1 触发保存HAR文件
+func notifySaveHAR(c chan os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
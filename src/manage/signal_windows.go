@@ -0,0 +1,9 @@
+package manage
+
+import (
+	"os"
+)
+
+// windows 没有 SIGUSR1, 只在退出时保存HAR文件
+func notifySaveHAR(c chan os.Signal) {
+}